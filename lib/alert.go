@@ -0,0 +1,287 @@
+package statsq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALERT_WEBHOOK_TIMEOUT = 5 * time.Second
+	// MAX_PENDING_NOTIFICATIONS are queued for the webhooks, further ones are dropped
+	MAX_PENDING_NOTIFICATIONS = 1000
+)
+
+// States of an alert, notifications are sent when an alert starts firing and when it is resolved.
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// 'api.latency.upper_99 > 500 for 3 intervals'
+var alertRuleRe = regexp.MustCompile(`^(.+?)\s*(>=|<=|==|!=|>|<)\s*(\S+?)(?:\s+for\s+(\d+)\s+intervals?)?\s*$`)
+
+// AlertRule compares an expression over the aggregated metrics to a threshold at each flush,
+// separately for each set of dimensions.
+type AlertRule struct {
+	Name      string
+	Expr      Expr
+	Op        string
+	Threshold float64
+	// For is the number of consecutive intervals the condition has to hold before the alert fires
+	For     int
+	Webhook string
+	states  map[string]*AlertState
+}
+
+// AlertState tracks an alert for one set of dimensions.
+type AlertState struct {
+	State      string
+	Count      int
+	Value      float64
+	Dimensions map[string]string
+	Since      time.Time
+}
+
+// AlertNotification is POSTed as JSON to the webhook of a rule.
+type AlertNotification struct {
+	Alert      string            `json:"alert"`
+	Rule       string            `json:"rule"`
+	State      string            `json:"state"`
+	Value      float64           `json:"value"`
+	Threshold  float64           `json:"threshold"`
+	Dimensions map[string]string `json:"dimensions"`
+	Since      time.Time         `json:"since"`
+	Time       time.Time         `json:"time"`
+}
+
+// ParseAlertRule parses a rule like 'api.latency.upper_99 > 500 for 3 intervals'.
+func ParseAlertRule(name, rule string) (*AlertRule, error) {
+	m := alertRuleRe.FindStringSubmatch(rule)
+	if m == nil {
+		return nil, fmt.Errorf("rule '%s' does not match '<expr> <op> <threshold> [for <n> intervals]'", rule)
+	}
+	expr, err := ParseExpr(m[1])
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold '%s'", m[3])
+	}
+	ar := &AlertRule{
+		Name:      name,
+		Expr:      expr,
+		Op:        m[2],
+		Threshold: threshold,
+		For:       1,
+		states:    map[string]*AlertState{},
+	}
+	if m[4] != "" {
+		ar.For, _ = strconv.Atoi(m[4])
+		if ar.For < 1 {
+			return nil, errors.New("needs to hold for at least 1 interval")
+		}
+	}
+	return ar, nil
+}
+
+// String returns the rule as configured.
+func (ar *AlertRule) String() string {
+	return fmt.Sprintf("%s %s %s for %d intervals", ar.Expr.String(), ar.Op, strconv.FormatFloat(ar.Threshold, 'f', -1, 64), ar.For)
+}
+
+func (ar *AlertRule) holds(val float64) bool {
+	switch ar.Op {
+	case ">":
+		return val > ar.Threshold
+	case ">=":
+		return val >= ar.Threshold
+	case "<":
+		return val < ar.Threshold
+	case "<=":
+		return val <= ar.Threshold
+	case "==":
+		return val == ar.Threshold
+	}
+	return val != ar.Threshold
+}
+
+// Evaluate advances the state of the alerts with the metrics of a flush and returns the notifications to send.
+// Sets of dimensions with missing operands count as not matching the condition.
+func (ar *AlertRule) Evaluate(ms MetricSet, now time.Time) (res []AlertNotification) {
+	seen := map[string]bool{}
+	for _, r := range ms.Eval(ar.Expr, false) {
+		if r.Err != nil || !ar.holds(r.Value) {
+			continue
+		}
+		seen[r.Key] = true
+		st, ok := ar.states[r.Key]
+		if !ok {
+			st = &AlertState{State: AlertPending, Dimensions: r.Dimensions, Since: now}
+			ar.states[r.Key] = st
+		}
+		st.Count++
+		st.Value = r.Value
+		if st.State == AlertPending && st.Count >= ar.For {
+			st.State = AlertFiring
+			res = append(res, ar.notification(st, now))
+		}
+	}
+	for key, st := range ar.states {
+		if seen[key] {
+			continue
+		}
+		if st.State == AlertFiring {
+			st.State = AlertResolved
+			res = append(res, ar.notification(st, now))
+		}
+		delete(ar.states, key)
+	}
+	return
+}
+
+// States returns the pending and firing alerts by dimension key.
+func (ar *AlertRule) States() map[string]AlertState {
+	res := make(map[string]AlertState, len(ar.states))
+	for k, st := range ar.states {
+		res[k] = *st
+	}
+	return res
+}
+
+func (ar *AlertRule) notification(st *AlertState, now time.Time) AlertNotification {
+	return AlertNotification{
+		Alert:      ar.Name,
+		Rule:       ar.String(),
+		State:      st.State,
+		Value:      st.Value,
+		Threshold:  ar.Threshold,
+		Dimensions: st.Dimensions,
+		Since:      st.Since,
+		Time:       now,
+	}
+}
+
+// NewAlertRulesFromConfig reads the rules listed in alerts from alert.<name>.{rule,webhook},
+// the webhook defaults to alert-webhook.
+func (sd *StatsQ) NewAlertRulesFromConfig() []*AlertRule {
+	rules := []*AlertRule{}
+	webhook := sd.StringOr("alert-webhook", "")
+	for _, name := range strings.Split(sd.String("alerts"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		path := fmt.Sprintf("alert.%s", name)
+		ar, err := ParseAlertRule(name, sd.String(path+".rule"))
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip alert '%s': %s", name, err.Error()))
+			continue
+		}
+		ar.Webhook = sd.StringOr(path+".webhook", webhook)
+		if ar.Webhook == "" {
+			sd.Log("warn", fmt.Sprintf("Alert '%s' has no webhook, state changes are only logged", name))
+		}
+		rules = append(rules, ar)
+	}
+	return rules
+}
+
+type webhookNotification struct {
+	url string
+	AlertNotification
+}
+
+// AlertNotifier POSTs the notifications to the webhooks one after another, so that they arrive in order.
+type AlertNotifier struct {
+	mu     sync.Mutex
+	queue  chan webhookNotification
+	closed bool
+	// drained is closed once the notifications queued are sent after the queue is closed
+	drained chan struct{}
+}
+
+// EvaluateAlerts advances all alert rules and notifies their webhooks in the background.
+func (sd *StatsQ) EvaluateAlerts(ms MetricSet, now time.Time) {
+	for _, ar := range sd.Alerts {
+		for _, n := range ar.Evaluate(ms, now) {
+			sd.Log("info", fmt.Sprintf("Alert '%s' %s: %s = %v %v", n.Alert, n.State, n.Rule, n.Value, n.Dimensions))
+			if ar.Webhook != "" {
+				sd.queueNotification(webhookNotification{ar.Webhook, n})
+			}
+		}
+	}
+}
+
+func (sd *StatsQ) queueNotification(wn webhookNotification) {
+	an := sd.Notifier
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	if an.closed {
+		sd.Log("error", fmt.Sprintf("Drop notification of alert '%s', statsq is stopped", wn.Alert))
+		return
+	}
+	if an.queue == nil {
+		an.queue = make(chan webhookNotification, MAX_PENDING_NOTIFICATIONS)
+		an.drained = make(chan struct{})
+		go func(queue chan webhookNotification, drained chan struct{}) {
+			for wn := range queue {
+				sd.notifyWebhook(wn.url, wn.AlertNotification)
+			}
+			close(drained)
+		}(an.queue, an.drained)
+	}
+	select {
+	case an.queue <- wn:
+	default:
+		sd.Log("error", fmt.Sprintf("Drop notification of alert '%s', too many pending", wn.Alert))
+	}
+}
+
+// close stops the webhook goroutine once the notifications queued are sent, waiting for it until ctx is done.
+// Notifications queued afterwards are dropped.
+func (an *AlertNotifier) close(ctx context.Context) error {
+	an.mu.Lock()
+	if an.closed || an.queue == nil {
+		an.closed = true
+		an.mu.Unlock()
+		return nil
+	}
+	an.closed = true
+	close(an.queue)
+	an.mu.Unlock()
+	select {
+	case <-an.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sd *StatsQ) notifyWebhook(url string, n AlertNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		sd.Log("error", err.Error())
+		return
+	}
+	client := http.Client{Timeout: ALERT_WEBHOOK_TIMEOUT}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		sd.Log("error", fmt.Sprintf("Failed to notify '%s' of alert '%s': %s", url, n.Alert, err.Error()))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		sd.Log("error", fmt.Sprintf("Failed to notify '%s' of alert '%s': %s", url, n.Alert, resp.Status))
+	}
+}
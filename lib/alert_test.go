@@ -0,0 +1,147 @@
+package statsq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseAlertRule(t *testing.T) {
+	ar, err := ParseAlertRule("latency", "api.latency.upper_99 > 500 for 3 intervals")
+	assert.NoError(t, err)
+	assert.Equal(t, ">", ar.Op)
+	assert.Equal(t, float64(500), ar.Threshold)
+	assert.Equal(t, 3, ar.For)
+	assert.Equal(t, []string{"api.latency.upper_99"}, ar.Expr.Names())
+	ar, err = ParseAlertRule("ratio", "errors / requests >= 0.05")
+	assert.NoError(t, err)
+	assert.Equal(t, ">=", ar.Op)
+	assert.Equal(t, 1, ar.For)
+	ar, err = ParseAlertRule("low", "free<-1e3 for 1 interval")
+	assert.NoError(t, err)
+	assert.Equal(t, "<", ar.Op)
+	assert.Equal(t, float64(-1000), ar.Threshold)
+	for _, rule := range []string{"", "a > ", "a > b", "> 5", "a + > 5", "a > 5 for 0 intervals", "a > 5 for 3"} {
+		_, err = ParseAlertRule("broken", rule)
+		assert.Error(t, err, rule)
+	}
+}
+
+func alertMetrics(vals map[string]float64) MetricSet {
+	ms := MetricSet{}
+	for host, v := range vals {
+		ms.Add(qtypes.NewExt("", "latency", qtypes.Gauge, v, map[string]string{"host": host}, time.Now(), false))
+	}
+	return ms
+}
+
+func TestAlertRule_Evaluate(t *testing.T) {
+	ar, _ := ParseAlertRule("latency", "latency > 500 for 2 intervals")
+	now := time.Unix(1495028544, 0)
+	res := ar.Evaluate(alertMetrics(map[string]float64{"a": 600, "b": 100}), now)
+	assert.Len(t, res, 0)
+	assert.Equal(t, AlertPending, ar.States()["host=a"].State)
+	assert.Len(t, ar.States(), 1)
+	res = ar.Evaluate(alertMetrics(map[string]float64{"a": 700, "b": 600}), now.Add(time.Second))
+	assert.Len(t, res, 1)
+	assert.Equal(t, AlertFiring, res[0].State)
+	assert.Equal(t, float64(700), res[0].Value)
+	assert.Equal(t, map[string]string{"host": "a"}, res[0].Dimensions)
+	assert.Equal(t, now, res[0].Since)
+	// b drops back before firing, a keeps firing without a new notification
+	res = ar.Evaluate(alertMetrics(map[string]float64{"a": 800, "b": 100}), now.Add(2*time.Second))
+	assert.Len(t, res, 0)
+	assert.Len(t, ar.States(), 1)
+	// a is missing
+	res = ar.Evaluate(alertMetrics(map[string]float64{"b": 100}), now.Add(3*time.Second))
+	assert.Len(t, res, 1)
+	assert.Equal(t, AlertResolved, res[0].State)
+	assert.Equal(t, float64(800), res[0].Value)
+	assert.Len(t, ar.States(), 0)
+}
+
+func TestAlertRulesFromConfigFile(t *testing.T) {
+	// the query string of the webhook is not cut off as comment
+	path, cleanup := writeTestConfig(t, "[alert.latency]\nrule = api.latency.upper_99 > 500 for 3 intervals\nwebhook = http://hooks.local/alert?team=api;env=prod#ops\n")
+	defer cleanup()
+	cfg, err := daemonConfig(t, "--config", path, "--alerts", "latency")
+	assert.NoError(t, err)
+	sd := NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	assert.Len(t, sd.Alerts, 1)
+	assert.Equal(t, 500.0, sd.Alerts[0].Threshold)
+	assert.Equal(t, 3, sd.Alerts[0].For)
+	assert.Equal(t, "http://hooks.local/alert?team=api;env=prod#ops", sd.Alerts[0].Webhook)
+}
+
+func TestStatsQAlertWebhook(t *testing.T) {
+	notes := make(chan AlertNotification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n AlertNotification
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		notes <- n
+	}))
+	defer srv.Close()
+	pre := map[string]string{
+		"alerts":             "latency",
+		"alert.latency.rule": "api.latency.upper_99 > 500 for 2 intervals",
+		"alert-webhook":      srv.URL,
+		"percentiles":        "99",
+		"backends":           "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.Alerts, 1)
+	now := time.Unix(1495028544, 0)
+	for i := 0; i < 3; i++ {
+		sd.ParseLine("api.latency:600|ms service=http")
+		sd.FlushWindow(sd.Window, now.Add(time.Duration(i)*time.Second))
+	}
+	sd.ParseLine("api.latency:100|ms service=http")
+	sd.FlushWindow(sd.Window, now.Add(3*time.Second))
+	for _, state := range []string{AlertFiring, AlertResolved} {
+		select {
+		case n := <-notes:
+			assert.Equal(t, "latency", n.Alert)
+			assert.Equal(t, state, n.State)
+			assert.Equal(t, map[string]string{"service": "http"}, n.Dimensions)
+			assert.Equal(t, now.Unix(), n.Since.Unix())
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("webhook receive timeout")
+		}
+	}
+	assert.Nil(t, sd.Window.collect)
+}
+
+func TestStatsQAlertWebhookShutdown(t *testing.T) {
+	notes := make(chan AlertNotification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n AlertNotification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		time.Sleep(100 * time.Millisecond)
+		notes <- n
+	}))
+	defer srv.Close()
+	pre := map[string]string{
+		"alerts":             "latency",
+		"alert.latency.rule": "api.latency.upper_99 > 500 for 2 intervals",
+		"alert-webhook":      srv.URL,
+		"percentiles":        "99",
+		"backends":           "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	sd.ParseLine("api.latency:600|ms")
+	sd.FlushWindow(sd.Window, time.Unix(1495028544, 0))
+	// the notification of the final flush is sent before Shutdown returns
+	sd.ParseLine("api.latency:600|ms")
+	assert.NoError(t, sd.Shutdown())
+	assert.Len(t, notes, 1)
+	sd.queueNotification(webhookNotification{srv.URL, AlertNotification{Alert: "latency"}})
+	assert.NoError(t, sd.Notifier.close(context.Background()))
+	assert.Len(t, notes, 1)
+}
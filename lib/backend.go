@@ -0,0 +1,193 @@
+package statsq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GRAPHITE_DIAL_TIMEOUT = 5 * time.Second
+)
+
+// Backend receives the aggregated metrics of each flush.
+type Backend interface {
+	Name() string
+	Send(m qtypes.Metric)
+	Flush() error
+}
+
+// Route sends metrics passing its filters to a backend.
+type Route struct {
+	Backend Backend
+	Filters FilterList
+}
+
+func NewRoute(b Backend, fl FilterList) Route {
+	return Route{
+		Backend: b,
+		Filters: fl,
+	}
+}
+
+func (r *Route) Send(m qtypes.Metric) {
+	if r.Filters.PassMetric(m) {
+		r.Backend.Send(m)
+	}
+}
+
+// QChanBackend forwards metrics to the Data channel of a QChan, which is how statsq is used within qframe.
+type QChanBackend struct {
+	name  string
+	qchan qtypes.QChan
+}
+
+func NewQChanBackend(name string, qchan qtypes.QChan) *QChanBackend {
+	return &QChanBackend{
+		name:  name,
+		qchan: qchan,
+	}
+}
+
+func (qb *QChanBackend) Name() string {
+	return qb.name
+}
+
+func (qb *QChanBackend) Send(m qtypes.Metric) {
+	qb.qchan.Data.Send(m)
+}
+
+func (qb *QChanBackend) Flush() error {
+	return nil
+}
+
+// GraphiteBackend buffers metrics in the graphite plaintext format (using graphite 1.1 tags for dimensions)
+// and sends them with each flush.
+type GraphiteBackend struct {
+	mu      sync.Mutex
+	name    string
+	address string
+	buffer  bytes.Buffer
+}
+
+func NewGraphiteBackend(name, address string) *GraphiteBackend {
+	return &GraphiteBackend{
+		name:    name,
+		address: address,
+	}
+}
+
+func (gb *GraphiteBackend) Name() string {
+	return gb.name
+}
+
+func (gb *GraphiteBackend) Send(m qtypes.Metric) {
+	gb.mu.Lock()
+	defer gb.mu.Unlock()
+	fmt.Fprintf(&gb.buffer, "%s %s %d\n", GraphiteName(m), strconv.FormatFloat(m.Value, 'f', -1, 64), m.Time.Unix())
+}
+
+func (gb *GraphiteBackend) Flush() error {
+	gb.mu.Lock()
+	defer gb.mu.Unlock()
+	if gb.buffer.Len() == 0 {
+		return nil
+	}
+	defer gb.buffer.Reset()
+	conn, err := net.DialTimeout("tcp", gb.address, GRAPHITE_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(gb.buffer.Bytes())
+	return err
+}
+
+// GraphiteName returns the metric name with its dimensions appended as graphite tags (name;key=value).
+func GraphiteName(m qtypes.Metric) string {
+	res := []string{m.Name}
+	keys := make([]string, 0, len(m.Dimensions))
+	for k := range m.Dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res = append(res, k+"="+m.Dimensions[k])
+	}
+	return strings.Join(res, ";")
+}
+
+// LogBackend prints the metrics in the OpenTSDB format, handy for debugging.
+type LogBackend struct {
+	name string
+}
+
+func NewLogBackend(name string) *LogBackend {
+	return &LogBackend{name: name}
+}
+
+func (lb *LogBackend) Name() string {
+	return lb.name
+}
+
+func (lb *LogBackend) Send(m qtypes.Metric) {
+	log.Printf("[%s] %s", lb.name, m.ToOpenTSDB())
+}
+
+func (lb *LogBackend) Flush() error {
+	return nil
+}
+
+// NewBackendFromConfig creates the backend named name; its type is taken from backend.<name>.type and defaults to the name.
+func (sd *StatsQ) NewBackendFromConfig(name string) (Backend, error) {
+	path := fmt.Sprintf("backend.%s", name)
+	typ := sd.StringOr(path+".type", name)
+	switch typ {
+	case "qchan":
+		return NewQChanBackend(name, sd.QChan), nil
+	case "graphite":
+		return NewGraphiteBackend(name, sd.StringOr(path+".address", sd.StringOr("graphite", "127.0.0.1:2003"))), nil
+	case "log":
+		return NewLogBackend(name), nil
+	}
+	return nil, fmt.Errorf("unknown backend type '%s'", typ)
+}
+
+// NewRoutesFromConfig creates a route for each backend listed in backends, each filtered by backend.<name>.{allow,deny}.
+func (sd *StatsQ) NewRoutesFromConfig() []Route {
+	routes := []Route{}
+	for _, name := range strings.Split(sd.StringOr("backends", "qchan"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		b, err := sd.NewBackendFromConfig(name)
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip backend '%s': %s", name, err.Error()))
+			continue
+		}
+		path := fmt.Sprintf("backend.%s", name)
+		routes = append(routes, NewRoute(b, sd.NewFilterListFromConfig(path+".allow", path+".deny")))
+	}
+	return routes
+}
+
+// FlushBackends flushes the backends of the routes, logging and returning errors.
+func (sd *StatsQ) FlushBackends(routes []Route) error {
+	errs := []error{}
+	for _, r := range routes {
+		if err := r.Backend.Flush(); err != nil {
+			sd.Log("error", fmt.Sprintf("Flushing backend '%s' failed: %s", r.Backend.Name(), err.Error()))
+			errs = append(errs, fmt.Errorf("backend '%s': %w", r.Backend.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
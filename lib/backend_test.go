@@ -0,0 +1,62 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGraphiteName(t *testing.T) {
+	m := qtypes.NewExt("", "requests", qtypes.Counter, 1, map[string]string{"service": "http", "host": "web1"}, time.Now(), false)
+	assert.Equal(t, "requests;host=web1;service=http", GraphiteName(m))
+	m = qtypes.NewExt("", "requests", qtypes.Counter, 1, map[string]string{}, time.Now(), false)
+	assert.Equal(t, "requests", GraphiteName(m))
+}
+
+func TestGraphiteBackend_Flush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	recv := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		recv <- string(b)
+	}()
+	gb := NewGraphiteBackend("graphite", ln.Addr().String())
+	assert.NoError(t, gb.Flush(), "empty flush should not connect")
+	now := time.Unix(1495028544, 0)
+	gb.Send(qtypes.NewExt("", "requests", qtypes.Counter, 1.5, map[string]string{"host": "web1"}, now, false))
+	gb.Send(qtypes.NewExt("", "load", qtypes.Gauge, 2, map[string]string{}, now, false))
+	assert.NoError(t, gb.Flush())
+	select {
+	case s := <-recv:
+		assert.Equal(t, "requests;host=web1 1.5 1495028544\nload 2 1495028544\n", s)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("graphite receive timeout")
+	}
+	assert.Equal(t, 0, gb.buffer.Len())
+}
+
+func TestNewRoutesFromConfig(t *testing.T) {
+	pre := map[string]string{
+		"backends":               "qchan,carbon,unknown",
+		"backend.carbon.type":    "graphite",
+		"backend.carbon.address": "127.0.0.1:12003",
+		"backend.carbon.deny":    "noisy",
+		"filter.noisy.name":      "noisy",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.Routes, 2)
+	assert.IsType(t, &QChanBackend{}, sd.Routes[0].Backend)
+	assert.IsType(t, &GraphiteBackend{}, sd.Routes[1].Backend)
+	assert.Equal(t, "127.0.0.1:12003", sd.Routes[1].Backend.(*GraphiteBackend).address)
+	assert.Len(t, sd.Routes[1].Filters.Deny, 1)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"github.com/qnib/qframe-types"
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -33,8 +34,14 @@ func (bid *BucketID) GenerateID() {
 		log.Panicf("BucketID already has ID '%s'", bid.ID)
 	}
 	idRaw := []string{bid.BucketName}
-	for key, val := range bid.Dimensions.Map {
-		idRaw = append(idRaw, key+"="+val)
+	// map iteration order is random, sort the keys to get a stable ID
+	keys := make([]string, 0, len(bid.Dimensions.Map))
+	for key := range bid.Dimensions.Map {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		idRaw = append(idRaw, key+"="+bid.Dimensions.Map[key])
 	}
 	s := strings.Join(idRaw, "_")
 	bid.ID = GenID(s)
@@ -0,0 +1,51 @@
+package statsq
+
+import (
+	"github.com/go-ini/ini"
+	"github.com/zpatrick/go-config"
+	"strings"
+)
+
+// ConfigFile reads settings from an INI file, so that the ones without a command line flag can be set: the
+// filters, backends, windows and rules configured by name. A key in a section is prefixed with the section name,
+// e.g. 'type = graphite' in '[backend.carbon]' is backend.carbon.type; keys before the first section are taken as is.
+type ConfigFile struct {
+	path string
+}
+
+func NewConfigFile(path string) *ConfigFile {
+	return &ConfigFile{path: path}
+}
+
+func (cf *ConfigFile) Load() (map[string]string, error) {
+	// bucket patterns and URLs may contain '#' and ';'
+	file, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, cf.path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]string{}
+	for _, section := range file.Sections() {
+		prefix := section.Name() + "."
+		if section.Name() == ini.DEFAULT_SECTION {
+			prefix = ""
+		}
+		for _, key := range section.Keys() {
+			settings[prefix+key.Name()] = strings.TrimSpace(key.String())
+		}
+	}
+	return settings, nil
+}
+
+// NewDaemonConfig returns the config of the daemon: the settings of the config file at path, if any, overridden
+// by the command line flags. The file is read once, an error is returned if that fails.
+func NewDaemonConfig(path string, flags config.Provider) (*config.Config, error) {
+	providers := []config.Provider{}
+	if path != "" {
+		providers = append(providers, config.NewOnceLoader(NewConfigFile(path)))
+	}
+	cfg := config.NewConfig(append(providers, flags))
+	if err := cfg.Load(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
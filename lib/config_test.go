@@ -0,0 +1,99 @@
+package statsq
+
+import (
+	"flag"
+	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpatrick/go-config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// daemonConfig builds the config like main.go, out of the flags parsed from args.
+func daemonConfig(t *testing.T, args ...string) (*config.Config, error) {
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "config"},
+		cli.StringFlag{Name: "prefix"},
+		cli.StringFlag{Name: "backends"},
+		cli.StringFlag{Name: "ingest-allow"},
+		cli.StringFlag{Name: "topk"},
+		cli.StringFlag{Name: "derived"},
+		cli.StringFlag{Name: "alerts"},
+		cli.StringFlag{Name: "gauge-resend"},
+		cli.StringFlag{Name: "gauge-resend-rules"},
+	}
+	set := flag.NewFlagSet("statsq", flag.ContinueOnError)
+	for _, f := range app.Flags {
+		f.Apply(set)
+	}
+	assert.NoError(t, set.Parse(args))
+	ctx := cli.NewContext(app, set, nil)
+	return NewDaemonConfig(ctx.String("config"), config.NewCLI(ctx, false))
+}
+
+// writeTestConfig writes content to a config file, which is removed by the returned func.
+func writeTestConfig(t *testing.T, content string) (string, func()) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	path := filepath.Join(dir, "statsq.ini")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+const testConfigFile = `
+prefix = file.
+backends = audit
+
+[filter.api]
+name = ^api\.requests#v[0-9]+;
+type = counter
+
+[backend.audit]
+type  = log
+allow = api
+`
+
+func TestNewDaemonConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsq.ini")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testConfigFile), 0644))
+
+	cfg, err := daemonConfig(t, "--config", path, "--prefix", "flag.", "--ingest-allow", "api")
+	assert.NoError(t, err)
+	sd := NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	// flags take precedence over the file
+	assert.Equal(t, "flag.", sd.String("prefix"))
+	assert.Equal(t, `^api\.requests#v[0-9]+;`, sd.String("filter.api.name"))
+	assert.Len(t, sd.IngestFilter.Allow, 1)
+	assert.True(t, sd.IngestFilter.Pass("api.requests#v2;", TypeCounter, nil))
+	assert.False(t, sd.IngestFilter.Pass("api.requests#v2;", TypeGauge, nil))
+	assert.Equal(t, []string{"audit"}, sd.Backends())
+	assert.Len(t, sd.Routes[0].Filters.Allow, 1)
+
+	// without a file only the flags are set
+	cfg, err = daemonConfig(t, "--backends", "log")
+	assert.NoError(t, err)
+	sd = NewStatsQ(cfg)
+	assert.Equal(t, "", sd.StringOr("prefix", ""))
+	assert.Equal(t, []string{"log"}, sd.Backends())
+
+	// windows send to their own backends
+	intervals := "intervals = 10s,1m\nbackends = log,audit\n[backend.audit]\ntype = log\n[interval.1m]\nbackends = audit\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(intervals), 0644))
+	cfg, err = daemonConfig(t, "--config", path)
+	assert.NoError(t, err)
+	sd = NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	assert.Len(t, sd.Windows, 2)
+	assert.Equal(t, "10s", sd.Windows[0].Name)
+	assert.Len(t, sd.Windows[0].Routes, 2)
+	assert.Len(t, sd.Windows[1].Routes, 1)
+	assert.Equal(t, "audit", sd.Windows[1].Routes[0].Backend.Name())
+
+	_, err = daemonConfig(t, "--config", filepath.Join(dir, "missing.ini"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package statsq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MissingSkip does not calculate a derived metric if an operand is missing for a set of dimensions
+	MissingSkip = "skip"
+	// MissingZero uses 0 for missing operands
+	MissingZero = "zero"
+)
+
+// MetricSet indexes the metrics sent during a flush by name and dimensions.
+type MetricSet map[string]map[string]qtypes.Metric
+
+func (ms MetricSet) Add(m qtypes.Metric) {
+	if _, ok := ms[m.Name]; !ok {
+		ms[m.Name] = map[string]qtypes.Metric{}
+	}
+	ms[m.Name][DimensionKey(m.Dimensions)] = m
+}
+
+// Get returns the metric with name and the dimension key.
+func (ms MetricSet) Get(name, dkey string) (qtypes.Metric, bool) {
+	m, ok := ms[name][dkey]
+	return m, ok
+}
+
+// DimensionKey returns the sorted 'key=value,...' representation of dimensions, used to join metrics.
+func DimensionKey(dims map[string]string) string {
+	res := make([]string, 0, len(dims))
+	for k, v := range dims {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// DerivedMetric is a gauge calculated at flush time out of the counters and gauges (including timer statistics)
+// with identical dimensions.
+type DerivedMetric struct {
+	Name    string
+	Expr    Expr
+	Missing string
+}
+
+// NewDerivedMetricsFromConfig reads the metrics listed in derived from derived.<name>.{expr,missing}.
+func (sd *StatsQ) NewDerivedMetricsFromConfig() []DerivedMetric {
+	res := []DerivedMetric{}
+	for _, name := range strings.Split(sd.String("derived"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		path := fmt.Sprintf("derived.%s", name)
+		expr, err := ParseExpr(sd.String(path + ".expr"))
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip derived metric '%s': %s", name, err.Error()))
+			continue
+		}
+		dm := DerivedMetric{
+			Name:    name,
+			Expr:    expr,
+			Missing: sd.StringOr(path+".missing", MissingSkip),
+		}
+		if dm.Missing != MissingSkip && dm.Missing != MissingZero {
+			sd.invalidSetting("warn", fmt.Sprintf("Unknown missing '%s' for derived metric '%s', fall back to '%s'", dm.Missing, name, MissingSkip))
+			dm.Missing = MissingSkip
+		}
+		res = append(res, dm)
+	}
+	return res
+}
+
+// ExprResult is the value of an expression for one set of dimensions.
+type ExprResult struct {
+	Key        string
+	Dimensions map[string]string
+	Value      float64
+	Err        error
+}
+
+// Eval evaluates the expression for each set of dimensions found among its operands,
+// missing operands count as 0 if zero is set.
+func (ms MetricSet) Eval(e Expr, zero bool) []ExprResult {
+	dkeys := map[string]map[string]string{}
+	for _, name := range e.Names() {
+		for dkey, m := range ms[name] {
+			dkeys[dkey] = m.Dimensions
+		}
+	}
+	res := make([]ExprResult, 0, len(dkeys))
+	for dkey, dims := range dkeys {
+		lookup := func(name string) (float64, bool) {
+			m, ok := ms.Get(name, dkey)
+			if !ok && zero {
+				return 0, true
+			}
+			return m.Value, ok
+		}
+		val, err := e.Eval(lookup)
+		res = append(res, ExprResult{Key: dkey, Dimensions: dims, Value: val, Err: err})
+	}
+	return res
+}
+
+// Evaluate calculates the derived metric for each set of dimensions found among its operands.
+// Sets of dimensions lacking an operand are skipped unless missing operands count as zero,
+// a division by zero skips the set of dimensions.
+func (dm *DerivedMetric) Evaluate(ms MetricSet, source string, now time.Time) (res []qtypes.Metric, errs []error) {
+	for _, r := range ms.Eval(dm.Expr, dm.Missing == MissingZero) {
+		if r.Err != nil {
+			if !errors.Is(r.Err, ErrMissingOperand) {
+				errs = append(errs, fmt.Errorf("derived metric '%s' {%s}: %s", dm.Name, r.Key, r.Err.Error()))
+			}
+			continue
+		}
+		d := make(map[string]string, len(r.Dimensions))
+		for k, v := range r.Dimensions {
+			d[k] = v
+		}
+		res = append(res, qtypes.NewExt(source, dm.Name, qtypes.Gauge, r.Value, d, now, false))
+	}
+	return
+}
+
+// FanOutDerived sends the derived metrics calculated from the metrics of the flush.
+func (sd *StatsQ) FanOutDerived(w *Window, ms MetricSet, now time.Time) int64 {
+	var num int64
+	for i := range sd.Derived {
+		metrics, errs := sd.Derived[i].Evaluate(ms, sd.Name, now)
+		for _, err := range errs {
+			sd.Log("debug", err.Error())
+		}
+		for _, m := range metrics {
+			sd.sendMetric(w, m)
+			num++
+		}
+	}
+	return num
+}
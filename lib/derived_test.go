@@ -0,0 +1,88 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewDerivedMetricsFromConfig(t *testing.T) {
+	pre := map[string]string{
+		"derived":               "ratio,broken,odd",
+		"derived.ratio.expr":    "cache.hit / (cache.hit + cache.miss)",
+		"derived.ratio.missing": "zero",
+		"derived.broken.expr":   "cache.hit /",
+		"derived.odd.expr":      "a + b",
+		"derived.odd.missing":   "guess",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.Derived, 2)
+	assert.Equal(t, "ratio", sd.Derived[0].Name)
+	assert.Equal(t, MissingZero, sd.Derived[0].Missing)
+	assert.Equal(t, MissingSkip, sd.Derived[1].Missing)
+}
+
+func TestDerivedMetricsFromConfigFile(t *testing.T) {
+	// a quoted expression is not unquoted by the INI parser
+	path, cleanup := writeTestConfig(t, "[derived.hitrate]\nexpr = \"cache.hit\" / \"cache.total\"\nmissing = zero\n")
+	defer cleanup()
+	cfg, err := daemonConfig(t, "--config", path, "--derived", "hitrate")
+	assert.NoError(t, err)
+	sd := NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	assert.Len(t, sd.Derived, 1)
+	assert.Equal(t, []string{"cache.hit", "cache.total"}, sd.Derived[0].Expr.Names())
+	assert.Equal(t, MissingZero, sd.Derived[0].Missing)
+}
+
+func TestDerivedMetric_Evaluate(t *testing.T) {
+	now := time.Unix(1495028544, 0)
+	ms := MetricSet{}
+	ms.Add(qtypes.NewExt("", "hit", qtypes.Counter, 3, map[string]string{"host": "a"}, now, false))
+	ms.Add(qtypes.NewExt("", "miss", qtypes.Counter, 1, map[string]string{"host": "a"}, now, false))
+	ms.Add(qtypes.NewExt("", "hit", qtypes.Counter, 2, map[string]string{"host": "b"}, now, false))
+	ms.Add(qtypes.NewExt("", "hit", qtypes.Counter, 0, map[string]string{"host": "c"}, now, false))
+	ms.Add(qtypes.NewExt("", "miss", qtypes.Counter, 0, map[string]string{"host": "c"}, now, false))
+	expr, _ := ParseExpr("hit / (hit + miss)")
+	dm := DerivedMetric{Name: "ratio", Expr: expr, Missing: MissingSkip}
+	res, errs := dm.Evaluate(ms, "test", now)
+	// host=b lacks 'miss', host=c divides by zero
+	assert.Len(t, errs, 1)
+	assert.Len(t, res, 1)
+	assert.Equal(t, "ratio", res[0].Name)
+	assert.Equal(t, qtypes.Gauge, res[0].MetricType)
+	assert.Equal(t, 0.75, res[0].Value)
+	assert.Equal(t, map[string]string{"host": "a"}, res[0].Dimensions)
+	dm.Missing = MissingZero
+	res, errs = dm.Evaluate(ms, "test", now)
+	assert.Len(t, errs, 1)
+	assert.Len(t, res, 2)
+}
+
+func TestStatsQFanOutDerived(t *testing.T) {
+	pre := map[string]string{
+		"derived":                  "cache.ratio",
+		"derived.cache.ratio.expr": "cache.hit / (cache.hit + cache.miss)",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("cache.hit:3|c host=a")
+	sd.ParseLine("cache.miss:1|c host=a")
+	sd.ParseLine("cache.hit:1|c host=b")
+	sd.FlushWindow(sd.Window, time.Unix(1495028544, 0))
+	got := map[string]float64{}
+	for i := 0; i < 4; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			got[met.Name+"_"+met.Dimensions["host"]] = met.Value
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+	assert.Equal(t, map[string]float64{"cache.hit_a": 3, "cache.miss_a": 1, "cache.hit_b": 1, "cache.ratio_a": 0.75}, got)
+	assert.Nil(t, sd.Window.collect)
+}
@@ -0,0 +1,94 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"os"
+	"strings"
+)
+
+const (
+	// PrecedenceGlobal lets global dimensions overwrite the ones set by a client (same as Metric.GetDimensions(defaults))
+	PrecedenceGlobal = "global"
+	// PrecedenceClient keeps dimensions set by a client and only adds missing global ones
+	PrecedenceClient = "client"
+)
+
+// GlobalDimensions are merged into every incoming packet before it is aggregated.
+type GlobalDimensions struct {
+	Map        map[string]string
+	Precedence string
+}
+
+func NewGlobalDimensions(precedence string) GlobalDimensions {
+	return GlobalDimensions{
+		Map:        map[string]string{},
+		Precedence: precedence,
+	}
+}
+
+// NewGlobalDimensionsFromConfig assembles the global dimensions out of
+// global-dimensions (key=value,...), global-dimensions-env (key=ENV_VAR,...) and
+// global-dimensions-hostname (key to store the hostname under).
+func (sd *StatsQ) NewGlobalDimensionsFromConfig() GlobalDimensions {
+	gd := NewGlobalDimensions(sd.StringOr("global-dimensions-precedence", PrecedenceGlobal))
+	if gd.Precedence != PrecedenceGlobal && gd.Precedence != PrecedenceClient {
+		sd.invalidSetting("warn", fmt.Sprintf("Unknown global-dimensions-precedence '%s', fall back to '%s'", gd.Precedence, PrecedenceGlobal))
+		gd.Precedence = PrecedenceGlobal
+	}
+	for k, v := range splitKeyValues(sd.String("global-dimensions")) {
+		gd.Add(k, v)
+	}
+	for k, env := range splitKeyValues(sd.String("global-dimensions-env")) {
+		if v := os.Getenv(env); v != "" {
+			gd.Add(k, v)
+		} else {
+			sd.Log("warn", fmt.Sprintf("Environment variable '%s' for global dimension '%s' is not set", env, k))
+		}
+	}
+	if key := sd.String("global-dimensions-hostname"); key != "" {
+		host, err := os.Hostname()
+		if err != nil {
+			sd.Log("error", fmt.Sprintf("Could not resolve hostname for global dimension '%s': %s", key, err.Error()))
+		} else {
+			gd.Add(key, host)
+		}
+	}
+	return gd
+}
+
+func (gd *GlobalDimensions) Add(key, val string) {
+	gd.Map[key] = val
+}
+
+// Merge returns the dimensions of a packet combined with the global ones, honouring the precedence.
+// The dimensions passed in are not altered.
+func (gd *GlobalDimensions) Merge(dims qtypes.Dimensions) qtypes.Dimensions {
+	if len(gd.Map) == 0 {
+		return dims
+	}
+	res := qtypes.NewDimensions()
+	for k, v := range dims.Map {
+		res.Add(k, v)
+	}
+	for k, v := range gd.Map {
+		if _, ok := res.Map[k]; ok && gd.Precedence == PrecedenceClient {
+			continue
+		}
+		res.Add(k, v)
+	}
+	return res
+}
+
+// splitKeyValues parses 'key1=val1,key2=val2' into a map, skipping malformed items.
+func splitKeyValues(s string) map[string]string {
+	res := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		res[kv[0]] = kv[1]
+	}
+	return res
+}
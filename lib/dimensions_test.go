@@ -0,0 +1,54 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestGlobalDimensions_Merge(t *testing.T) {
+	gd := NewGlobalDimensions(PrecedenceGlobal)
+	gd.Add("dc", "eu1")
+	gd.Add("host", "node1")
+	dims := qtypes.NewDimensionsPre(map[string]string{"host": "web1", "service": "http"})
+	res := gd.Merge(dims)
+	assert.Equal(t, "dc=eu1,host=node1,service=http", res.String())
+	assert.Equal(t, "host=web1,service=http", dims.String(), "input should not be altered")
+	gd.Precedence = PrecedenceClient
+	res = gd.Merge(dims)
+	assert.Equal(t, "dc=eu1,host=web1,service=http", res.String())
+}
+
+func TestGlobalDimensions_MergeEmpty(t *testing.T) {
+	gd := NewGlobalDimensions(PrecedenceGlobal)
+	dims := qtypes.NewDimensionsPre(map[string]string{"service": "http"})
+	assert.Equal(t, dims, gd.Merge(dims))
+}
+
+func TestNewGlobalDimensionsFromConfig(t *testing.T) {
+	os.Setenv("STATSQ_TEST_DC", "eu1")
+	defer os.Unsetenv("STATSQ_TEST_DC")
+	host, _ := os.Hostname()
+	pre := map[string]string{
+		"global-dimensions":            "cluster=prod,broken",
+		"global-dimensions-env":        "dc=STATSQ_TEST_DC,rack=STATSQ_TEST_UNSET",
+		"global-dimensions-hostname":   "host",
+		"global-dimensions-precedence": "client",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	exp := map[string]string{"cluster": "prod", "dc": "eu1", "host": host}
+	assert.Equal(t, exp, sd.GlobalDims.Map)
+	assert.Equal(t, PrecedenceClient, sd.GlobalDims.Precedence)
+}
+
+func TestStatsQGlobalDimensions(t *testing.T) {
+	pre := map[string]string{"global-dimensions": "dc=eu1,cluster=prod"}
+	sd := NewStatsQ(NewPreCfg(pre))
+	sd.ParseLine("gorets:1|c")
+	sd.ParseLine("gorets:2|c dc=eu1,cluster=prod")
+	gid := GenID("gorets_cluster=prod_dc=eu1")
+	assert.Equal(t, float64(3), sd.Counters[gid])
+	bid := sd.BucketMapping[gid]
+	assert.Equal(t, "cluster=prod,dc=eu1", bid.Dimensions.String())
+}
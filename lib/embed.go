@@ -0,0 +1,257 @@
+package statsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"github.com/zpatrick/go-config"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Option configures a StatsQ created by New.
+type Option func(o *options) error
+
+type options struct {
+	name     string
+	qchan    *qtypes.QChan
+	settings map[string]string
+	backends []Backend
+}
+
+// WithName names the StatsQ, which does not change the settings of the options.
+func WithName(name string) Option {
+	return func(o *options) error {
+		o.name = name
+		return nil
+	}
+}
+
+// WithConfig sets a setting by the name of its command line flag, e.g. WithConfig("percentiles", "90,99").
+func WithConfig(key, value string) Option {
+	return func(o *options) error {
+		if key == "" {
+			return fmt.Errorf("empty config key")
+		}
+		o.settings[key] = value
+		return nil
+	}
+}
+
+// WithUDPAddress sets the address of the UDP listener, '-' disables it. It defaults to :8125.
+func WithUDPAddress(address string) Option {
+	return WithConfig("address", address)
+}
+
+// WithTCPAddress sets the address of the TCP listener.
+func WithTCPAddress(address string) Option {
+	return WithConfig("tcpaddr", address)
+}
+
+// WithHTTPAddress sets the address of the HTTP ingestion endpoints.
+func WithHTTPAddress(address string) Option {
+	return WithConfig("http-addr", address)
+}
+
+// WithGraphiteAddress sets the address the graphite plaintext protocol is accepted on, via TCP and UDP.
+func WithGraphiteAddress(address string) Option {
+	return WithConfig("graphite-input", address)
+}
+
+// WithPrefix sets the prefix added to the buckets received by the listeners.
+func WithPrefix(prefix string) Option {
+	return WithConfig("prefix", prefix)
+}
+
+// WithFlushInterval sets the interval of the default window.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < time.Millisecond {
+			return fmt.Errorf("flush interval %s is shorter than 1ms", interval)
+		}
+		o.settings["send-metric-ms"] = strconv.FormatInt(int64(interval/time.Millisecond), 10)
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets how long Shutdown waits for the listeners and the final flush.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("shutdown timeout %s is not positive", timeout)
+		}
+		o.settings["shutdown-timeout"] = timeout.String()
+		return nil
+	}
+}
+
+// WithQChan sets the QChan the qchan backend sends to.
+func WithQChan(qchan qtypes.QChan) Option {
+	return func(o *options) error {
+		o.qchan = &qchan
+		return nil
+	}
+}
+
+// WithBackend sends the metrics of all windows to b, in addition to the backends configured.
+func WithBackend(b Backend) Option {
+	return func(o *options) error {
+		if b == nil {
+			return fmt.Errorf("nil backend")
+		}
+		o.backends = append(o.backends, b)
+		return nil
+	}
+}
+
+// New creates a StatsQ to embed into a service. Settings not set by an option have the defaults of the command line,
+// New fails if a setting is invalid instead of skipping it or falling back to its default like the command line.
+func New(opts ...Option) (*StatsQ, error) {
+	o := &options{settings: map[string]string{}}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	settings := map[string]string{}
+	for k, v := range o.settings {
+		if o.name != "" {
+			k = fmt.Sprintf("%s.%s", o.name, k)
+		}
+		settings[k] = v
+	}
+	qchan := qtypes.NewQChan()
+	if o.qchan != nil {
+		qchan = *o.qchan
+	}
+	sd := NewNamedStatsQ(o.name, config.NewConfig([]config.Provider{config.NewStatic(settings)}), qchan)
+	if err := sd.checkSettings(); err != nil {
+		return nil, err
+	}
+	for _, b := range o.backends {
+		r := NewRoute(b, FilterList{})
+		sd.Routes = append(sd.Routes, r)
+		for _, w := range sd.Windows {
+			// copied, as windows might share the routes of StatsQ
+			w.Routes = append(w.Routes[:len(w.Routes):len(w.Routes)], r)
+		}
+	}
+	return &sd, nil
+}
+
+// checkSettings returns the settings NewNamedStatsQ skipped or replaced, along with the ones only read by Start.
+func (sd *StatsQ) checkSettings() error {
+	errs := sd.cfgErrs
+	if _, err := sd.shutdownTimeout(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, key := range []string{"send-metric-ms", "shards", "udp-readers", "udp-batch", "max-udp-packet-size"} {
+		if n := sd.IntOr(key, 1); n < 1 {
+			errs = append(errs, fmt.Errorf("%s %d is not positive", key, n))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid settings: %w", err)
+	}
+	return nil
+}
+
+// Start starts the listeners configured and the aggregation in the background, returning once the listeners
+// are bound. If a listener fails, the ones started before are closed again. ctx bounds the start only.
+func (sd *StatsQ) Start(ctx context.Context) error {
+	if err := sd.life.start(); err != nil {
+		return err
+	}
+	// the shards have to exist before the listeners dispatch packets to them
+	if len(sd.Shards) == 0 {
+		sd.StartShards(sd.ShardCount())
+	}
+	listeners := []func() error{
+		sd.startUDPListener,
+		sd.startTCPListener,
+		sd.startUnixgramListener,
+		sd.startUnixListener,
+		sd.startHTTPListener,
+		sd.startGraphiteListener,
+	}
+	for _, start := range listeners {
+		err := ctx.Err()
+		if err == nil {
+			err = start()
+		}
+		if err != nil {
+			sd.Shutdown()
+			return err
+		}
+	}
+	go sd.LoopChannel()
+	return nil
+}
+
+// Stop shuts down like Shutdown, waiting until ctx is done instead of shutdown-timeout.
+func (sd *StatsQ) Stop(ctx context.Context) error {
+	return sd.shutdown(ctx)
+}
+
+// Ingest aggregates a packet produced in-process, like the ones received by the listeners. Dimensions and
+// sampling may be left empty; like in a line, values that are not finite and sampling outside of (0,1] are rejected.
+// It is safe for concurrent use once Start returned.
+func (sd *StatsQ) Ingest(sp *qtypes.StatsdPacket) error {
+	if sp.Bucket == "" {
+		return fmt.Errorf("missing bucket")
+	}
+	if modifierFor(sp.Modifier) != sp.Modifier {
+		return fmt.Errorf("unknown type '%s'", sp.Modifier)
+	}
+	if sp.Modifier != "s" && (math.IsNaN(sp.ValFlt) || math.IsInf(sp.ValFlt, 0)) {
+		return fmt.Errorf("value %v is not finite", sp.ValFlt)
+	}
+	if sp.Sampling == 0 {
+		sp.Sampling = 1
+	}
+	if !(sp.Sampling > 0 && sp.Sampling <= 1) {
+		return fmt.Errorf("sampling %v is not within (0,1]", sp.Sampling)
+	}
+	if !sd.life.enter() {
+		return ErrStopped
+	}
+	defer sd.life.exit()
+	if sp.Dimensions.Map == nil {
+		sp.Dimensions = qtypes.NewDimensions()
+	}
+	sd.Dispatch(sp)
+	return nil
+}
+
+// Intervals returns the flush interval of each window, by its name.
+func (sd *StatsQ) Intervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration, len(sd.Windows))
+	for _, w := range sd.Windows {
+		intervals[w.Name] = w.Interval
+	}
+	return intervals
+}
+
+// Backends returns the names of the backends the metrics are sent to.
+func (sd *StatsQ) Backends() []string {
+	names := make([]string, len(sd.Routes))
+	for i, r := range sd.Routes {
+		names[i] = r.Backend.Name()
+	}
+	return names
+}
+
+// Addrs returns the addresses the listeners are bound to, by the setting of their address (address, tcpaddr,
+// http-addr, graphite-input, unix-socket, unixgram-socket), e.g. to find out the port picked for ':0'.
+func (sd *StatsQ) Addrs() map[string]net.Addr {
+	sd.life.mu.Lock()
+	defer sd.life.mu.Unlock()
+	addrs := make(map[string]net.Addr, len(sd.life.addrs))
+	for k, v := range sd.life.addrs {
+		addrs[k] = v
+	}
+	return addrs
+}
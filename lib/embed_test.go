@@ -0,0 +1,123 @@
+package statsq
+
+import (
+	"context"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	rb := &recordingBackend{sums: map[string]float64{}}
+	sd, err := New(
+		WithName("embedded"),
+		WithConfig("intervals", "10s,1m"),
+		WithConfig("backends", "log"),
+		WithPrefix("app."),
+		WithShutdownTimeout(time.Second),
+		WithBackend(rb),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "app.", sd.String("prefix"))
+	assert.Equal(t, time.Second, sd.ShutdownTimeout())
+	assert.Equal(t, []string{"log", "recording"}, sd.Backends())
+	assert.Equal(t, map[string]time.Duration{"10s": 10 * time.Second, "1m": time.Minute}, sd.Intervals())
+	for _, w := range sd.Windows {
+		assert.Len(t, w.Routes, 2)
+		assert.Equal(t, rb, w.Routes[1].Backend)
+	}
+
+	sd, err = New(WithFlushInterval(250 * time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, sd.Window.Interval)
+
+	for _, opt := range []Option{WithFlushInterval(0), WithShutdownTimeout(-time.Second), WithBackend(nil), WithConfig("", "x")} {
+		_, err = New(opt)
+		assert.Error(t, err)
+	}
+
+	// invalid settings are not skipped
+	invalid := map[string]string{
+		"percentile-method":     "median",
+		"percentiles":           "100",
+		"intervals":             "10s,-1m",
+		"set-hll-precision":     "20",
+		"queue-overflow":        "retry",
+		"shutdown-timeout":      "soon",
+		"shards":                "0",
+		"send-metric-ms":        "0",
+		"timer-sketch":          "(",
+		"timer-sketch-accuracy": "1.5",
+		"timer-sketch-max-bins": "0",
+	}
+	for key, val := range invalid {
+		_, err = New(WithConfig(key, val))
+		assert.Error(t, err, key)
+	}
+	_, err = New(WithConfig("percentile-method", "median"), WithConfig("shards", "-1"))
+	assert.EqualError(t, err, "invalid settings: Unknown percentile-method 'median', fall back to 'nearest-rank'\nshards -1 is not positive")
+}
+
+func TestStatsQ_StartStop(t *testing.T) {
+	rb := &recordingBackend{sums: map[string]float64{}}
+	sd, err := New(
+		WithUDPAddress("127.0.0.1:0"),
+		WithTCPAddress("127.0.0.1:0"),
+		WithHTTPAddress("127.0.0.1:0"),
+		WithConfig("backends", "log"),
+		WithFlushInterval(time.Hour),
+		WithBackend(rb),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, sd.Start(context.Background()))
+	assert.Equal(t, ErrStarted, sd.Start(context.Background()))
+	addrs := sd.Addrs()
+	assert.Len(t, addrs, 3)
+	for _, key := range []string{"address", "tcpaddr", "http-addr"} {
+		assert.NotContains(t, addrs[key].String(), ":0", key)
+	}
+
+	resp, err := http.Post("http://"+addrs["http-addr"].String()+"/v1/statsd", "text/plain", strings.NewReader("gorets:2|c\n"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 4, Modifier: "c"}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 4, Modifier: "counter"}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{ValFlt: 4, Modifier: "c"}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: math.NaN(), Modifier: "c"}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "glork", ValFlt: math.Inf(-1), Modifier: "ms"}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 4, Modifier: "c", Sampling: 1.5}))
+	assert.Error(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 4, Modifier: "c", Sampling: -0.5}))
+	assert.NoError(t, sd.Ingest(&qtypes.StatsdPacket{Bucket: "uniques", ValStr: "765", ValFlt: math.NaN(), Modifier: "s"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, sd.Stop(ctx))
+	assert.Equal(t, float64(6), rb.Sum("gorets"))
+	assert.Equal(t, ErrStopped, sd.Ingest(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 4, Modifier: "c"}))
+	assert.Equal(t, ErrStopped, sd.Start(context.Background()))
+	_, err = net.Dial("tcp", addrs["tcpaddr"].String())
+	assert.Error(t, err)
+}
+
+func TestStatsQ_StartFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer busy.Close()
+	sd, err := New(WithUDPAddress("-"), WithHTTPAddress("127.0.0.1:0"), WithGraphiteAddress(busy.Addr().String()), WithConfig("backends", "log"))
+	assert.NoError(t, err)
+	assert.Error(t, sd.Start(context.Background()))
+	// the listeners started before are closed
+	_, err = net.Dial("tcp", sd.Addrs()["http-addr"].String())
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sd, _ = New(WithUDPAddress("127.0.0.1:0"), WithConfig("backends", "log"))
+	assert.Equal(t, context.Canceled, sd.Start(ctx))
+}
@@ -0,0 +1,223 @@
+package statsq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingOperand = errors.New("missing operand")
+	ErrDivisionByZero = errors.New("division by zero")
+)
+
+// Expr is an arithmetic expression over metric names, e.g. 'cache.hit / (cache.hit + cache.miss)'.
+// Names consist of letters, digits, '_' and '.'; other names (e.g. containing '-') have to be double quoted.
+type Expr interface {
+	// Eval calculates the expression, looking up the values of names.
+	Eval(lookup func(name string) (float64, bool)) (float64, error)
+	// Names returns the metric names used in the expression.
+	Names() []string
+	String() string
+}
+
+type numberExpr float64
+
+func (e numberExpr) Eval(lookup func(string) (float64, bool)) (float64, error) {
+	return float64(e), nil
+}
+func (e numberExpr) Names() []string { return nil }
+func (e numberExpr) String() string  { return strconv.FormatFloat(float64(e), 'f', -1, 64) }
+
+type nameExpr string
+
+func (e nameExpr) Eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, ok := lookup(string(e))
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrMissingOperand, string(e))
+	}
+	return v, nil
+}
+func (e nameExpr) Names() []string { return []string{string(e)} }
+func (e nameExpr) String() string  { return strconv.Quote(string(e)) }
+
+type negExpr struct {
+	x Expr
+}
+
+func (e negExpr) Eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, err := e.x.Eval(lookup)
+	return -v, err
+}
+func (e negExpr) Names() []string { return e.x.Names() }
+func (e negExpr) String() string  { return "(-" + e.x.String() + ")" }
+
+type binaryExpr struct {
+	op   byte
+	l, r Expr
+}
+
+func (e binaryExpr) Eval(lookup func(string) (float64, bool)) (float64, error) {
+	l, err := e.l.Eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	r, err := e.r.Eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	}
+	if r == 0 {
+		return 0, ErrDivisionByZero
+	}
+	return l / r, nil
+}
+func (e binaryExpr) Names() []string { return append(e.l.Names(), e.r.Names()...) }
+func (e binaryExpr) String() string {
+	return "(" + e.l.String() + " " + string(e.op) + " " + e.r.String() + ")"
+}
+
+// exprParser is a recursive descent parser for
+//
+//	expr   = term { ('+'|'-') term }
+//	term   = factor { ('*'|'/') factor }
+//	factor = number | name | '"' name '"' | '-' factor | '(' expr ')'
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// ParseExpr parses an expression.
+func ParseExpr(s string) (Expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected '%c' at %d", p.s[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (Expr, error) {
+	l, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return l, nil
+		}
+		p.pos++
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op, l, r}
+	}
+}
+
+func (p *exprParser) term() (Expr, error) {
+	l, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return l, nil
+		}
+		p.pos++
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op, l, r}
+	}
+}
+
+func (p *exprParser) factor() (Expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		x, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '"':
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end < 1 {
+			return nil, fmt.Errorf("unterminated or empty name at %d", p.pos)
+		}
+		name := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return nameExpr(name), nil
+	case (c >= '0' && c <= '9') || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] == 'e' || p.s[p.pos] == 'E' ||
+			((p.s[p.pos] == '+' || p.s[p.pos] == '-') && (p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E'))) {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at %d", p.s[start:p.pos], start)
+		}
+		return numberExpr(f), nil
+	case isNameStart(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isNameStart(p.s[p.pos]) || isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return nameExpr(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected '%c' at %d", c, p.pos)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
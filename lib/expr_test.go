@@ -0,0 +1,59 @@
+package statsq
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	vals := map[string]float64{
+		"cache.hit":    3,
+		"cache.miss":   1,
+		"api.upper_99": 250,
+		"disk-free":    10,
+	}
+	lookup := func(name string) (float64, bool) {
+		v, ok := vals[name]
+		return v, ok
+	}
+	exp := map[string]float64{
+		"cache.hit / (cache.hit + cache.miss)": 0.75,
+		"1 + 2 * 3":                            7,
+		"(1 + 2) * 3":                          9,
+		"10 - 4 - 3":                           3,
+		"-cache.hit * 2":                       -6,
+		"api.upper_99 / 1e3":                   0.25,
+		"\"disk-free\" * 1.5":                  15,
+	}
+	for s, v := range exp {
+		e, err := ParseExpr(s)
+		assert.NoError(t, err, s)
+		got, err := e.Eval(lookup)
+		assert.NoError(t, err, s)
+		assert.Equal(t, v, got, s)
+	}
+	e, _ := ParseExpr("cache.hit / (cache.hit + cache.miss)")
+	assert.Equal(t, []string{"cache.hit", "cache.hit", "cache.miss"}, e.Names())
+	assert.Equal(t, "(\"cache.hit\" / (\"cache.hit\" + \"cache.miss\"))", e.String())
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, s := range []string{"", "1 +", "(a + b", "a b", "\"\"", "\"a", "1..2", "a % b"} {
+		_, err := ParseExpr(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	lookup := func(name string) (float64, bool) {
+		return 0, name == "zero"
+	}
+	e, _ := ParseExpr("1 / zero")
+	_, err := e.Eval(lookup)
+	assert.True(t, errors.Is(err, ErrDivisionByZero))
+	e, _ = ParseExpr("zero + unknown")
+	_, err = e.Eval(lookup)
+	assert.True(t, errors.Is(err, ErrMissingOperand))
+	assert.Contains(t, err.Error(), "unknown")
+}
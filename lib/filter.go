@@ -0,0 +1,135 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"regexp"
+	"strings"
+)
+
+// Metric types used to filter incoming packets, derived from the statsd modifier.
+const (
+	TypeCounter = qtypes.Counter
+	TypeGauge   = qtypes.Gauge
+	TypeTimer   = "timer"
+	TypeSet     = "set"
+)
+
+// MetricFilter wraps a qtypes.Filter with a precompiled name regex, since Metric.IsFiltered compiles it on every call.
+type MetricFilter struct {
+	qtypes.Filter
+	re *regexp.Regexp
+}
+
+func NewMetricFilter(f qtypes.Filter) (MetricFilter, error) {
+	mf := MetricFilter{Filter: f}
+	if f.Name == "" {
+		return mf, nil
+	}
+	re, err := regexp.Compile(f.Name)
+	if err != nil {
+		return mf, err
+	}
+	mf.re = re
+	return mf, nil
+}
+
+// Match follows the semantics of Metric.IsFiltered, except that an empty name or type matches everything.
+func (mf *MetricFilter) Match(name, typ string, dims map[string]string) bool {
+	for k, v := range mf.Dimensions {
+		val, ok := dims[k]
+		if !ok || v != val {
+			return false
+		}
+	}
+	if mf.MetricType != "" && mf.MetricType != typ {
+		return false
+	}
+	if mf.re != nil && !mf.re.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// FilterList combines allow and deny filters; deny wins and an empty allow list allows everything.
+type FilterList struct {
+	Allow []MetricFilter
+	Deny  []MetricFilter
+}
+
+func (fl *FilterList) IsEmpty() bool {
+	return len(fl.Allow) == 0 && len(fl.Deny) == 0
+}
+
+// Pass returns true if the metric is allowed to pass.
+func (fl *FilterList) Pass(name, typ string, dims map[string]string) bool {
+	for _, f := range fl.Deny {
+		if f.Match(name, typ, dims) {
+			return false
+		}
+	}
+	if len(fl.Allow) == 0 {
+		return true
+	}
+	for _, f := range fl.Allow {
+		if f.Match(name, typ, dims) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fl *FilterList) PassMetric(m qtypes.Metric) bool {
+	return fl.Pass(m.Name, m.MetricType, m.Dimensions)
+}
+
+// PacketType maps the statsd modifier of a packet to the type used by filters.
+func PacketType(modifier string) string {
+	switch modifier {
+	case "c":
+		return TypeCounter
+	case "g":
+		return TypeGauge
+	case "ms":
+		return TypeTimer
+	case "s":
+		return TypeSet
+	}
+	return modifier
+}
+
+// NewFilterFromConfig reads the filter with the given name from filter.<name>.{name,type,dimensions}.
+func (sd *StatsQ) NewFilterFromConfig(name string) (MetricFilter, error) {
+	path := fmt.Sprintf("filter.%s", name)
+	f := qtypes.NewFilter(
+		sd.String(path+".name"),
+		sd.String(path+".type"),
+		splitKeyValues(sd.String(path+".dimensions")),
+	)
+	return NewMetricFilter(f)
+}
+
+// NewFilterListFromConfig builds a FilterList out of the comma separated filter names found under allowPath and denyPath.
+func (sd *StatsQ) NewFilterListFromConfig(allowPath, denyPath string) FilterList {
+	return FilterList{
+		Allow: sd.filtersFromConfig(allowPath),
+		Deny:  sd.filtersFromConfig(denyPath),
+	}
+}
+
+func (sd *StatsQ) filtersFromConfig(path string) []MetricFilter {
+	res := []MetricFilter{}
+	for _, name := range strings.Split(sd.String(path), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, err := sd.NewFilterFromConfig(name)
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip filter '%s' in '%s': %s", name, path, err.Error()))
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
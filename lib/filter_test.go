@@ -0,0 +1,101 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMetricFilter_Match(t *testing.T) {
+	f, err := NewMetricFilter(qtypes.NewFilter("^api\\.", TypeCounter, map[string]string{"service": "http"}))
+	assert.NoError(t, err)
+	dims := map[string]string{"service": "http", "host": "web1"}
+	assert.True(t, f.Match("api.requests", TypeCounter, dims))
+	assert.False(t, f.Match("db.requests", TypeCounter, dims))
+	assert.False(t, f.Match("api.requests", TypeGauge, dims))
+	assert.False(t, f.Match("api.requests", TypeCounter, map[string]string{"host": "web1"}))
+	// empty name and type match everything
+	f, err = NewMetricFilter(qtypes.NewFilter("", "", map[string]string{}))
+	assert.NoError(t, err)
+	assert.True(t, f.Match("db.requests", TypeTimer, dims))
+	_, err = NewMetricFilter(qtypes.NewFilter("(", "", map[string]string{}))
+	assert.Error(t, err)
+}
+
+func TestFilterList_Pass(t *testing.T) {
+	api, _ := NewMetricFilter(qtypes.NewFilter("^api\\.", "", nil))
+	noisy, _ := NewMetricFilter(qtypes.NewFilter("\\.noisy$", "", nil))
+	fl := FilterList{}
+	assert.True(t, fl.IsEmpty())
+	assert.True(t, fl.Pass("db.noisy", TypeGauge, nil))
+	fl.Deny = []MetricFilter{noisy}
+	assert.False(t, fl.Pass("db.noisy", TypeGauge, nil))
+	assert.True(t, fl.Pass("db.requests", TypeGauge, nil))
+	fl.Allow = []MetricFilter{api}
+	assert.False(t, fl.Pass("db.requests", TypeGauge, nil))
+	assert.True(t, fl.Pass("api.requests", TypeGauge, nil))
+	assert.False(t, fl.Pass("api.noisy", TypeGauge, nil))
+}
+
+func TestPacketType(t *testing.T) {
+	assert.Equal(t, TypeCounter, PacketType("c"))
+	assert.Equal(t, TypeGauge, PacketType("g"))
+	assert.Equal(t, TypeTimer, PacketType("ms"))
+	assert.Equal(t, TypeSet, PacketType("s"))
+}
+
+func TestStatsQIngestFilter(t *testing.T) {
+	pre := map[string]string{
+		"ingest-deny":              "noisy,timers",
+		"filter.noisy.name":        "^noisy\\.",
+		"filter.timers.type":       "timer",
+		"filter.timers.dimensions": "env=dev",
+		"filter.broken.name":       "(",
+		"ingest-allow":             "broken",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.IngestFilter.Deny, 2)
+	assert.Len(t, sd.IngestFilter.Allow, 0)
+	sd.ParseLine("noisy.bucket:1|c")
+	sd.ParseLine("quiet.bucket:1|c")
+	sd.ParseLine("quiet.timer:1|ms env=dev")
+	sd.ParseLine("quiet.timer:2|ms env=prod")
+	_, ok := sd.Counters[GenID("noisy.bucket")]
+	assert.False(t, ok)
+	assert.Equal(t, float64(1), sd.Counters[GenID("quiet.bucket")])
+	_, ok = sd.Timers[GenID("quiet.timer_env=dev")]
+	assert.False(t, ok)
+	assert.Equal(t, Float64Slice{2}, sd.Timers[GenID("quiet.timer_env=prod")])
+}
+
+func TestStatsQEgressFilter(t *testing.T) {
+	pre := map[string]string{
+		"backends":            "qchan,debug",
+		"backend.qchan.allow": "api",
+		"backend.debug.type":  "log",
+		"filter.api.name":     "^api\\.",
+	}
+	cfg := NewPreCfg(pre)
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", cfg, qchan)
+	assert.Len(t, sd.Routes, 2)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("db.requests:1|c")
+	sd.ParseLine("api.requests:2|c")
+	sd.FanOutMetrics()
+	select {
+	case val := <-dc.Read:
+		met := val.(qtypes.Metric)
+		assert.Equal(t, "api.requests", met.Name)
+		assert.Equal(t, float64(2), met.Value)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("metrics receive timeout")
+	}
+	select {
+	case val := <-dc.Read:
+		t.Fatalf("unexpected metric %v", val)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,87 @@
+package statsq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Modes to resend the last value of gauges that are not updated.
+const (
+	// GaugeResendOnce sends a gauge in the interval it was updated and suppresses it afterwards
+	GaugeResendOnce = "once"
+	// GaugeResendForever sends the last value of a gauge at every flush (the statsd default)
+	GaugeResendForever = "forever"
+	// GAUGE_RESEND_FOREVER is the number of intervals used for GaugeResendForever
+	GAUGE_RESEND_FOREVER = -1
+)
+
+// GaugeResendRule sets the number of intervals inactive gauges matching the bucket patterns are resent.
+type GaugeResendRule struct {
+	Name      string
+	Bucket    BucketPatterns
+	Intervals int
+}
+
+// ParseGaugeResend parses 'once', 'forever' or the number of intervals the last value is resent.
+func ParseGaugeResend(s string) (int, error) {
+	switch s {
+	case GaugeResendOnce:
+		return 0, nil
+	case GaugeResendForever:
+		return GAUGE_RESEND_FOREVER, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("gauge resend '%s' is neither '%s', '%s' nor a number of intervals", s, GaugeResendOnce, GaugeResendForever)
+	}
+	return n, nil
+}
+
+// NewGaugeResendFromConfig returns the default of gauge-resend and the rules listed in gauge-resend-rules,
+// which are read from gauge-resend.<name>.{bucket,mode}, e.g. a [gauge-resend.<name>] section of the config file.
+// Without gauge-resend, gauges are resent forever unless delete-gauges is set, which resent-gauges overrides.
+func (sd *StatsQ) NewGaugeResendFromConfig() (int, []GaugeResendRule) {
+	def := GaugeResendForever
+	if sd.Bool("delete-gauges") {
+		def = GaugeResendOnce
+	}
+	if sd.Bool("resent-gauges") {
+		def = GaugeResendForever
+	}
+	resend, err := ParseGaugeResend(sd.StringOr("gauge-resend", def))
+	if err != nil {
+		sd.invalidSetting("error", fmt.Sprintf("%s, fall back to '%s'", err.Error(), def))
+		resend, _ = ParseGaugeResend(def)
+	}
+	rules := []GaugeResendRule{}
+	for _, name := range strings.Split(sd.String("gauge-resend-rules"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		path := fmt.Sprintf("gauge-resend.%s", name)
+		bp, err := NewBucketPatterns(sd.String(path + ".bucket"))
+		if err != nil || len(bp) == 0 {
+			sd.invalidSetting("error", fmt.Sprintf("Skip gauge resend rule '%s': needs valid bucket patterns", name))
+			continue
+		}
+		n, err := ParseGaugeResend(sd.String(path + ".mode"))
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip gauge resend rule '%s': %s", name, err.Error()))
+			continue
+		}
+		rules = append(rules, GaugeResendRule{Name: name, Bucket: bp, Intervals: n})
+	}
+	return resend, rules
+}
+
+// GaugeResendFor returns the number of intervals an inactive gauge is resent, using the first matching rule.
+func (sd *StatsQ) GaugeResendFor(bucket string) int {
+	for _, r := range sd.GaugeResendRules {
+		if r.Bucket.Match(bucket) {
+			return r.Intervals
+		}
+	}
+	return sd.GaugeResend
+}
@@ -0,0 +1,59 @@
+package statsq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseGaugeResend(t *testing.T) {
+	exp := map[string]int{
+		"once":    0,
+		"forever": GAUGE_RESEND_FOREVER,
+		"0":       0,
+		"3":       3,
+	}
+	for s, n := range exp {
+		got, err := ParseGaugeResend(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, n, got, s)
+	}
+	for _, s := range []string{"", "-1", "always", "1.5"} {
+		_, err := ParseGaugeResend(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestGaugeResendRulesFromConfigFile(t *testing.T) {
+	path, cleanup := writeTestConfig(t, "[gauge-resend.queue]\nbucket = ^queue\\.\nmode = 3\n")
+	defer cleanup()
+	cfg, err := daemonConfig(t, "--config", path, "--gauge-resend", "once", "--gauge-resend-rules", "queue")
+	assert.NoError(t, err)
+	sd := NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	assert.Len(t, sd.GaugeResendRules, 1)
+	assert.Equal(t, 3, sd.OptionsFor("queue.depth").GaugeResend)
+	assert.Equal(t, 0, sd.OptionsFor("cpu.load").GaugeResend)
+}
+
+func TestNewGaugeResendFromConfig(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{}))
+	assert.Equal(t, GAUGE_RESEND_FOREVER, sd.GaugeResend)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"delete-gauges": "true"}))
+	assert.Equal(t, 0, sd.GaugeResend)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"delete-gauges": "true", "resent-gauges": "true"}))
+	assert.Equal(t, GAUGE_RESEND_FOREVER, sd.GaugeResend)
+	pre := map[string]string{
+		"gauge-resend":               "5",
+		"gauge-resend-rules":         "queue,broken,nomode",
+		"gauge-resend.queue.bucket":  "^queue\\.",
+		"gauge-resend.queue.mode":    "once",
+		"gauge-resend.broken.bucket": "(",
+		"gauge-resend.broken.mode":   "once",
+		"gauge-resend.nomode.bucket": "x",
+	}
+	sd = NewStatsQ(NewPreCfg(pre))
+	assert.Equal(t, 5, sd.GaugeResend)
+	assert.Len(t, sd.GaugeResendRules, 1)
+	assert.Equal(t, 0, sd.OptionsFor("queue.depth").GaugeResend)
+	assert.Equal(t, 5, sd.OptionsFor("cpu.load").GaugeResend)
+}
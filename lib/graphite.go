@@ -0,0 +1,102 @@
+package statsq
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"io"
+	"math"
+	"net"
+	"strconv"
+)
+
+// parseGraphiteLine parses a line of the graphite plaintext protocol ('path value timestamp') into a gauge.
+// Graphite 1.1 tags ('path;tag=value') become dimensions. The timestamp is checked but not used, as the
+// gauge is flushed with the interval it is received in.
+func (mp *MsgParser) parseGraphiteLine(line []byte) (*qtypes.StatsdPacket, error) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) != 3 && len(fields) != 2 {
+		return nil, newParseError(ParseErrMalformed, "expected 'path value timestamp'", line)
+	}
+	val, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		return nil, newParseError(ParseErrValue, fmt.Sprintf("invalid value '%s'", fields[1]), line)
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(string(fields[2]), 64); err != nil {
+			return nil, newParseError(ParseErrValue, fmt.Sprintf("invalid timestamp '%s'", fields[2]), line)
+		}
+	}
+	path := fields[0]
+	var tags []byte
+	if idx := bytes.IndexByte(path, ';'); idx >= 0 {
+		path, tags = path[:idx], path[idx+1:]
+	}
+	if len(path) == 0 {
+		return nil, newParseError(ParseErrMalformed, "empty path", line)
+	}
+	dims := qtypes.Dimensions{Map: make(map[string]string, bytes.Count(tags, []byte{';'})+1)}
+	for len(tags) > 0 {
+		tag := tags
+		if idx := bytes.IndexByte(tags, ';'); idx >= 0 {
+			tag, tags = tags[:idx], tags[idx+1:]
+		} else {
+			tags = nil
+		}
+		idx := bytes.IndexByte(tag, '=')
+		if idx < 1 || idx == len(tag)-1 {
+			return nil, newParseError(ParseErrDimension, fmt.Sprintf("invalid tag '%s'", tag), line)
+		}
+		dims.Map[mp.intern(tag[:idx])] = mp.intern(tag[idx+1:])
+	}
+	return &qtypes.StatsdPacket{
+		Bucket:     mp.bucket(path),
+		ValFlt:     val,
+		Modifier:   "g",
+		Sampling:   1,
+		Dimensions: dims,
+	}, nil
+}
+
+// ParseGraphiteTo dispatches the gauges read from a connection speaking the graphite plaintext protocol.
+func (sd *StatsQ) ParseGraphiteTo(conn io.ReadCloser, partialReads bool) {
+	parser := NewParser(conn, partialReads, sd.Bool("debug"), sd.IntOr("max-udp-packet-size", DEFAULT_MAX_UDP_PACKET_SIZE), "", "")
+	parser.graphite = true
+	sd.parseFrom(conn, parser)
+}
+
+// startGraphiteListener accepts the graphite plaintext protocol on TCP and UDP, like carbon does.
+func (sd *StatsQ) startGraphiteListener() error {
+	address := sd.StringOr("graphite-input", "")
+	if address == "" {
+		return nil
+	}
+	listener, err := ListenTCP(address, nil)
+	if err != nil {
+		return fmt.Errorf("graphite input - %w", err)
+	}
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("graphite input - %w", err)
+	}
+	if !sd.life.track(listener) {
+		conn.Close()
+		return ErrStopped
+	}
+	sd.Log("info", fmt.Sprintf("graphite input listening on %s (tcp and udp)", listener.Addr()))
+	sd.life.bind("graphite-input", listener.Addr())
+	go sd.ParseGraphiteTo(conn.(*net.UDPConn), false)
+	go sd.serveGraphite(listener)
+	return nil
+}
+
+func (sd *StatsQ) serveGraphite(listener net.Listener) {
+	sd.serve(listener, func(conn net.Conn) {
+		sd.ParseGraphiteTo(conn, true)
+	})
+}
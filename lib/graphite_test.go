@@ -0,0 +1,84 @@
+package statsq
+
+import (
+	"errors"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	mp := &MsgParser{graphite: true}
+	sp, err := mp.parse([]byte("servers.web1.cpu 42.5 1495028544"))
+	assert.NoError(t, err)
+	assert.Equal(t, &qtypes.StatsdPacket{Bucket: "servers.web1.cpu", ValFlt: 42.5, Modifier: "g", Sampling: 1, Dimensions: qtypes.NewDimensions()}, sp)
+
+	sp, err = mp.parse([]byte("disk.used;host=web1;mount=/var  -3\t1495028544.5\r"))
+	assert.NoError(t, err)
+	assert.Equal(t, "disk.used", sp.Bucket)
+	assert.Equal(t, float64(-3), sp.ValFlt)
+	assert.Equal(t, "", sp.ValStr)
+	assert.Equal(t, map[string]string{"host": "web1", "mount": "/var"}, sp.Dimensions.Map)
+
+	sp, err = mp.parse([]byte("no.timestamp 1"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), sp.ValFlt)
+
+	sp, err = mp.parse([]byte("  "))
+	assert.Nil(t, sp)
+	assert.NoError(t, err)
+
+	cases := map[string]error{
+		"servers.web1.cpu":                   ErrMalformedLine,
+		"servers.web1.cpu 1 2 3":             ErrMalformedLine,
+		";host=web1 1 1495028544":            ErrMalformedLine,
+		"servers.web1.cpu x 1495028544":      ErrBadValue,
+		"servers.web1.cpu nan 1495028544":    ErrBadValue,
+		"servers.web1.cpu Inf 1495028544":    ErrBadValue,
+		"servers.web1.cpu +Inf 1495028544":   ErrBadValue,
+		"servers.web1.cpu -Inf 1495028544":   ErrBadValue,
+		"servers.web1.cpu 1 yesterday":       ErrBadValue,
+		"servers.web1.cpu;host 1 1495028544": ErrBadDimension,
+		"servers.web1.cpu;host= 1":           ErrBadDimension,
+		"servers.web1.cpu;=web1 1":           ErrBadDimension,
+	}
+	for line, exp := range cases {
+		sp, err := mp.parse([]byte(line))
+		assert.Nil(t, sp, line)
+		assert.True(t, errors.Is(err, exp), "%q: expected %v, got %v", line, exp.(*ParseError).Class, err)
+	}
+}
+
+func TestStatsQ_GraphiteInput(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log", "prefix": "statsd."}))
+	listener, err := ListenTCP("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go sd.serveGraphite(listener)
+	c, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	c.Write([]byte("servers.web1.cpu;dc=eu 42 1495028544\nbroken\nservers.web1.mem 1024 1495028544\n"))
+	c.Close()
+	sp := receivePacket(t, &sd)
+	assert.Equal(t, "servers.web1.cpu", sp.Bucket)
+	assert.Equal(t, map[string]string{"dc": "eu"}, sp.Dimensions.Map)
+	sp = receivePacket(t, &sd)
+	assert.Equal(t, "servers.web1.mem", sp.Bucket)
+	assert.Equal(t, float64(1024), sp.ValFlt)
+	assert.Equal(t, uint64(1), sd.ParseErrors.Stats()[ParseErrMalformed])
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go sd.ParseGraphiteTo(conn.(*net.UDPConn), false)
+	c, err = net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	c.Write([]byte("servers.web2.cpu 7 1495028544\nservers.web2.mem 8 1495028544"))
+	c.Close()
+	for _, exp := range []string{"servers.web2.cpu", "servers.web2.mem"} {
+		sp = receivePacket(t, &sd)
+		assert.Equal(t, exp, sp.Bucket)
+		assert.Equal(t, "g", sp.Modifier)
+	}
+	conn.Close()
+}
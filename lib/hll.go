@@ -0,0 +1,174 @@
+package statsq
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	HLL_MIN_PRECISION     = 4
+	HLL_MAX_PRECISION     = 18
+	HLL_DEFAULT_PRECISION = 14
+)
+
+// HyperLogLog estimates the number of unique values using 2^precision registers instead of keeping all values.
+// Count uses the improved estimator of Ertl ("New cardinality estimation algorithms for HyperLogLog sketches",
+// 2017), which is unbiased for small and large cardinalities alike, without the empirical bias tables of HLL++.
+// The relative standard error is 1.04/sqrt(2^precision), e.g. 0.81% for precision 14.
+// Until a tenth of the registers are set, they are kept sparse in a map, so that sets of a few values do not
+// cost 2^precision bytes (16KB for precision 14).
+type HyperLogLog struct {
+	precision uint8
+	// sparse holds the registers set as long as registers is nil
+	sparse    map[uint32]uint8
+	registers []uint8
+}
+
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < HLL_MIN_PRECISION || precision > HLL_MAX_PRECISION {
+		return nil, fmt.Errorf("HLL precision %d not in [%d,%d]", precision, HLL_MIN_PRECISION, HLL_MAX_PRECISION)
+	}
+	return &HyperLogLog{
+		precision: precision,
+		sparse:    map[uint32]uint8{},
+	}, nil
+}
+
+// hllHash is FNV-1a mixed with the splitmix64 finalizer, as FNV alone does not spread short strings well enough.
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *HyperLogLog) Add(s string) {
+	x := hllHash(s)
+	idx := uint32(x >> (64 - h.precision))
+	w := x<<h.precision | 1<<(h.precision-1)
+	h.set(idx, uint8(bits.LeadingZeros64(w))+1)
+}
+
+func (h *HyperLogLog) set(idx uint32, rho uint8) {
+	if h.registers != nil {
+		if rho > h.registers[idx] {
+			h.registers[idx] = rho
+		}
+		return
+	}
+	if rho > h.sparse[idx] {
+		h.sparse[idx] = rho
+		if len(h.sparse) > h.size()/10 {
+			h.densify()
+		}
+	}
+}
+
+// densify moves the sparse registers to the slice of all registers.
+func (h *HyperLogLog) densify() {
+	h.registers = make([]uint8, h.size())
+	for idx, rho := range h.sparse {
+		h.registers[idx] = rho
+	}
+	h.sparse = nil
+}
+
+func (h *HyperLogLog) size() int {
+	return 1 << h.precision
+}
+
+// Merge combines another HLL with the same precision, e.g. from another window or shard.
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if h.precision != o.precision {
+		return fmt.Errorf("can not merge HLL with precision %d into %d", o.precision, h.precision)
+	}
+	if o.registers == nil {
+		for idx, rho := range o.sparse {
+			h.set(idx, rho)
+		}
+		return nil
+	}
+	if h.registers == nil {
+		h.densify()
+	}
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated cardinality.
+func (h *HyperLogLog) Count() float64 {
+	// q+1 is the largest register value possible
+	q := 64 - int(h.precision)
+	hist := make([]int, q+2)
+	if h.registers == nil {
+		hist[0] = h.size() - len(h.sparse)
+		for _, r := range h.sparse {
+			hist[r]++
+		}
+	} else {
+		for _, r := range h.registers {
+			hist[r]++
+		}
+	}
+	m := float64(h.size())
+	z := m * hllTau(1-float64(hist[q+1])/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + float64(hist[k]))
+	}
+	z += m * hllSigma(float64(hist[0])/m)
+	return m * m / (2 * math.Ln2 * z)
+}
+
+// hllSigma corrects for the registers that are still 0, see Ertl (2017).
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// hllTau corrects for the registers that hold the largest value possible, see Ertl (2017).
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// RelativeError returns the relative standard error of the estimate.
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(h.size()))
+}
+
+func (h *HyperLogLog) Precision() uint8 {
+	return h.precision
+}
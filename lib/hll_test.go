@@ -0,0 +1,126 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewHyperLogLog(t *testing.T) {
+	_, err := NewHyperLogLog(3)
+	assert.Error(t, err)
+	_, err = NewHyperLogLog(19)
+	assert.Error(t, err)
+	h, err := NewHyperLogLog(14)
+	assert.NoError(t, err)
+	assert.Nil(t, h.registers)
+	assert.InDelta(t, 0.0081, h.RelativeError(), 0.0001)
+	assert.Equal(t, float64(0), h.Count())
+}
+
+func TestHyperLogLog_Count(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		h, _ := NewHyperLogLog(14)
+		for i := 0; i < n; i++ {
+			// add every value twice, duplicates must not be counted
+			h.Add("user" + strconv.Itoa(i))
+			h.Add("user" + strconv.Itoa(i))
+		}
+		assert.InEpsilon(t, float64(n), h.Count(), 4*h.RelativeError(), "cardinality %d", n)
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a, _ := NewHyperLogLog(12)
+	b, _ := NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		if i < 15000 {
+			a.Add(strconv.Itoa(i))
+		}
+		if i >= 5000 {
+			b.Add(strconv.Itoa(i))
+		}
+	}
+	assert.NoError(t, a.Merge(b))
+	assert.InEpsilon(t, 20000, a.Count(), 4*a.RelativeError())
+	c, _ := NewHyperLogLog(10)
+	assert.Error(t, a.Merge(c))
+}
+
+func TestHyperLogLog_Sparse(t *testing.T) {
+	h, _ := NewHyperLogLog(14)
+	for i := 0; i < 1000; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+	assert.Nil(t, h.registers)
+	assert.InEpsilon(t, 1000, h.Count(), 4*h.RelativeError())
+	dense, _ := NewHyperLogLog(14)
+	for i := 1000; i < 20000; i++ {
+		dense.Add(strconv.Itoa(i))
+	}
+	assert.Nil(t, dense.sparse)
+	assert.Len(t, dense.registers, 16384)
+	// merging a dense HLL into a sparse one and the other way round
+	other, _ := NewHyperLogLog(14)
+	assert.NoError(t, other.Merge(dense))
+	assert.NoError(t, other.Merge(h))
+	assert.NoError(t, h.Merge(dense))
+	assert.Equal(t, other.registers, h.registers)
+	assert.InEpsilon(t, 20000, h.Count(), 4*h.RelativeError())
+}
+
+func TestHyperLogLog_Bias(t *testing.T) {
+	// the mean of the estimates has to be unbiased around 2.5*2^precision, where raw HLL switches from
+	// linear counting and overestimates by about 1.5%
+	for _, n := range []int{10000, 42000, 60000} {
+		var sum float64
+		runs := 20
+		for r := 0; r < runs; r++ {
+			h, _ := NewHyperLogLog(14)
+			for i := 0; i < n; i++ {
+				h.Add(strconv.Itoa(r) + "-" + strconv.Itoa(i))
+			}
+			sum += h.Count()
+		}
+		assert.InEpsilon(t, float64(n), sum/float64(runs), 0.005, "cardinality %d", n)
+	}
+}
+
+func TestStatsQFanOutHLLSets(t *testing.T) {
+	pre := map[string]string{
+		"set-hll":           "^users$",
+		"set-hll-precision": "12",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("users:alice|s")
+	sd.ParseLine("users:bob|s")
+	sd.ParseLine("users:alice|s")
+	sd.ParseLine("other:alice|s")
+	gid := GenID("users")
+	assert.Equal(t, uint8(12), sd.HLLSets[gid].Precision())
+	assert.Len(t, sd.Sets[gid], 0)
+	assert.Len(t, sd.Sets[GenID("other")], 1)
+	num := sd.FanOutSets(time.Unix(1495028544, 0))
+	assert.Equal(t, int64(2), num)
+	exp := map[string]float64{
+		"users":       2.0,
+		"users.error": 2 * 1.04 / 64,
+		"other":       1.0,
+	}
+	tr := NewTimerResult(exp)
+	for !tr.Check() {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			tr.Input(met.Name, met.Value)
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal(tr.Result())
+		}
+	}
+	assert.Len(t, sd.HLLSets, 0)
+}
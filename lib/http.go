@@ -0,0 +1,293 @@
+package statsq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_HTTP_MAX_BODY = 1 << 20
+)
+
+// HTTPMetric is a metric posted to /v1/metrics.
+type HTTPMetric struct {
+	Bucket string `json:"bucket"`
+	// Type is the statsd type code (c, g, ms, s) or its name (counter, gauge, timer, set)
+	Type string `json:"type"`
+	// Value is a number, or a string as it is sent in a statsd line (e.g. "+4" to increment a gauge, set members)
+	Value      json.RawMessage   `json:"value"`
+	SampleRate *float64          `json:"sample_rate,omitempty"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+}
+
+// HTTPResult is the response to an ingestion request.
+type HTTPResult struct {
+	Accepted int         `json:"accepted"`
+	Errors   []HTTPError `json:"errors,omitempty"`
+}
+
+// HTTPError describes why a line (counted from 1) or an element of the JSON array (counted from 0) was rejected.
+type HTTPError struct {
+	Line  int    `json:"line,omitempty"`
+	Index *int   `json:"index,omitempty"`
+	Class string `json:"class"`
+	Error string `json:"error"`
+}
+
+// HTTPHandler returns the handler of the HTTP ingestion endpoints, including the one compatible with the Pushgateway.
+func (sd *StatsQ) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/statsd", sd.handleStatsdLines)
+	mux.HandleFunc("/v1/metrics", sd.handleJSONMetrics)
+	mux.HandleFunc("/metrics/job/", sd.handlePushgateway)
+	return mux
+}
+
+func (sd *StatsQ) startHTTPListener() error {
+	address := sd.StringOr("http-addr", "")
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("HTTP listener - %w", err)
+	}
+	srv := &http.Server{Handler: sd.HTTPHandler()}
+	// shut down gracefully, so that the requests in flight are ingested
+	if !sd.life.track(srv) {
+		listener.Close()
+		return ErrStopped
+	}
+	sd.Log("info", fmt.Sprintf("HTTP ingestion listening on %s", listener.Addr()))
+	sd.life.bind("http-addr", listener.Addr())
+	go func() {
+		defer sd.life.untrack(srv)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			sd.Log("error", fmt.Sprintf("HTTP listener - %s", err.Error()))
+		}
+	}()
+	return nil
+}
+
+// allowMethods writes the error response if the method of the request is not one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Sprintf("only %s supported", strings.Join(methods, " and ")))
+	return false
+}
+
+// readBody returns the (gunzipped) request body, writing the error response if it fails.
+func (sd *StatsQ) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	maxBody := int64(sd.IntOr("http-max-body", DEFAULT_HTTP_MAX_BODY))
+	body := http.MaxBytesReader(w, r.Body, maxBody)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid gzip body: %s", err.Error()))
+			return nil, false
+		}
+		defer gz.Close()
+		// the limit applies to the uncompressed body as well
+		body = http.MaxBytesReader(w, gz, maxBody)
+	default:
+		writeHTTPError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Encoding '%s'", r.Header.Get("Content-Encoding")))
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(body)
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		writeHTTPError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", maxBody))
+		return nil, false
+	case err != nil:
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("reading body: %s", err.Error()))
+		return nil, false
+	}
+	return data, true
+}
+
+// handleStatsdLines ingests newline separated statsd lines. Valid lines are ingested even if others are not.
+func (sd *StatsQ) handleStatsdLines(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	data, ok := sd.readBody(w, r)
+	if !ok {
+		return
+	}
+	mp := &MsgParser{prefix: sd.String("prefix"), postfix: sd.String("postfix")}
+	res := HTTPResult{}
+	for num := 1; len(data) > 0; num++ {
+		line := data
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			line, data = data[:idx], data[idx+1:]
+		} else {
+			data = nil
+		}
+		sp, err := mp.parseLine(bytes.TrimSuffix(line, []byte{'\r'}))
+		if err != nil {
+			sd.ParseErrors.Add(err)
+			res.Errors = append(res.Errors, newHTTPError(err, num, nil))
+			continue
+		}
+		if sp != nil {
+			sd.Dispatch(sp)
+			res.Accepted++
+		}
+	}
+	writeHTTPResult(w, res)
+}
+
+// handleJSONMetrics ingests a JSON array of metrics. Valid metrics are ingested even if others are not.
+func (sd *StatsQ) handleJSONMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	data, ok := sd.readBody(w, r)
+	if !ok {
+		return
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("expected a JSON array of metrics: %s", err.Error()))
+		return
+	}
+	prefix, postfix := sd.String("prefix"), sd.String("postfix")
+	res := HTTPResult{}
+	for i, item := range items {
+		sp, err := parseHTTPMetric(item, prefix, postfix)
+		if err != nil {
+			sd.ParseErrors.Add(err)
+			idx := i
+			res.Errors = append(res.Errors, newHTTPError(err, 0, &idx))
+			continue
+		}
+		sd.Dispatch(sp)
+		res.Accepted++
+	}
+	writeHTTPResult(w, res)
+}
+
+// parseHTTPMetric converts a metric posted as JSON into a packet, returning a *ParseError if it is invalid.
+func parseHTTPMetric(item json.RawMessage, prefix, postfix string) (*qtypes.StatsdPacket, error) {
+	var m HTTPMetric
+	if err := json.Unmarshal(item, &m); err != nil {
+		return nil, newParseError(ParseErrMalformed, err.Error(), item)
+	}
+	bucket := sanitizeBucket(prefix + m.Bucket + postfix)
+	if m.Bucket == "" || bucket == "" {
+		return nil, newParseError(ParseErrMalformed, "missing bucket", item)
+	}
+	sp := &qtypes.StatsdPacket{
+		Bucket:     bucket,
+		Modifier:   modifierFor(m.Type),
+		Sampling:   1,
+		Dimensions: qtypes.NewDimensions(),
+	}
+	if sp.Modifier == "" {
+		return nil, newParseError(ParseErrType, fmt.Sprintf("unknown type '%s'", m.Type), item)
+	}
+	if len(m.Value) == 0 {
+		return nil, newParseError(ParseErrValue, "missing value", item)
+	}
+	val := string(m.Value)
+	var s string
+	quoted := json.Unmarshal(m.Value, &s) == nil
+	if quoted {
+		val = s
+	}
+	switch sp.Modifier {
+	case "s":
+		sp.ValStr = val
+	case "g":
+		// a negative number sets the gauge, only a string like in a statsd line changes it
+		if quoted && (strings.HasPrefix(val, "+") || strings.HasPrefix(val, "-")) {
+			sp.ValStr, val = val[:1], val[1:]
+		}
+		fallthrough
+	default:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, newParseError(ParseErrValue, fmt.Sprintf("invalid value %s", m.Value), item)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, newParseError(ParseErrValue, fmt.Sprintf("value %s is not finite", m.Value), item)
+		}
+		sp.ValFlt = f
+	}
+	if m.SampleRate != nil {
+		if *m.SampleRate <= 0 || *m.SampleRate > 1 {
+			return nil, newParseError(ParseErrSampleRate, fmt.Sprintf("sample rate %v is not within (0,1]", *m.SampleRate), item)
+		}
+		if sp.Modifier == "c" || sp.Modifier == "ms" {
+			sp.Sampling = float32(*m.SampleRate)
+		}
+	}
+	for k, v := range m.Dimensions {
+		if k == "" {
+			return nil, newParseError(ParseErrDimension, "empty dimension key", item)
+		}
+		sp.Dimensions.Add(k, v)
+	}
+	return sp, nil
+}
+
+// modifierFor returns the statsd type code of typ, which is either a code or a type name as used by filters.
+func modifierFor(typ string) string {
+	switch typ {
+	case "c", TypeCounter:
+		return "c"
+	case "g", TypeGauge:
+		return "g"
+	case "ms", TypeTimer:
+		return "ms"
+	case "s", TypeSet:
+		return "s"
+	}
+	return ""
+}
+
+func newHTTPError(err error, line int, index *int) HTTPError {
+	he := HTTPError{Line: line, Index: index, Class: ParseErrMalformed, Error: err.Error()}
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		he.Class = pe.Class
+	}
+	return he
+}
+
+// writeHTTPResult responds 200 if everything was accepted, 400 otherwise.
+func writeHTTPResult(w http.ResponseWriter, res HTTPResult) {
+	status := http.StatusOK
+	if len(res.Errors) > 0 {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, res)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, HTTPResult{Errors: []HTTPError{{Class: "request", Error: msg}}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
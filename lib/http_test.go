@@ -0,0 +1,155 @@
+package statsq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postHTTP(sd *StatsQ, path, body string, gz bool) (int, HTTPResult) {
+	var buf bytes.Buffer
+	if gz {
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(body))
+		zw.Close()
+	} else {
+		buf.WriteString(body)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, &buf)
+	if gz {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, req)
+	res := HTTPResult{}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res
+}
+
+func drainPackets(sd *StatsQ) []*qtypes.StatsdPacket {
+	res := []*qtypes.StatsdPacket{}
+	for {
+		select {
+		case sp := <-sd.In:
+			res = append(res, sp)
+		default:
+			return res
+		}
+	}
+}
+
+func TestStatsQ_HTTPStatsd(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log", "prefix": "app."}))
+	for _, gz := range []bool{false, true} {
+		code, res := postHTTP(&sd, "/v1/statsd", "gorets:1|c|@0.5\r\ngaugor:-2|g host=a\n\nuniques:765|s\n", gz)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, HTTPResult{Accepted: 3}, res)
+		pkts := drainPackets(&sd)
+		assert.Len(t, pkts, 3)
+		assert.Equal(t, "app.gorets", pkts[0].Bucket)
+		assert.Equal(t, float32(0.5), pkts[0].Sampling)
+		assert.Equal(t, "-", pkts[1].ValStr)
+		assert.Equal(t, map[string]string{"host": "a"}, pkts[1].Dimensions.Map)
+		assert.Equal(t, "765", pkts[2].ValStr)
+	}
+
+	code, res := postHTTP(&sd, "/v1/statsd", "gorets:1|c\ngorets:x|c\ngaugor:1|z\ngaugor:1|g host", false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Len(t, drainPackets(&sd), 1)
+	assert.Len(t, res.Errors, 3)
+	for i, exp := range []HTTPError{{Line: 2, Class: ParseErrValue}, {Line: 3, Class: ParseErrType}, {Line: 4, Class: ParseErrDimension}} {
+		assert.Equal(t, exp.Line, res.Errors[i].Line)
+		assert.Equal(t, exp.Class, res.Errors[i].Class)
+		assert.NotEmpty(t, res.Errors[i].Error)
+	}
+	assert.Equal(t, uint64(1), sd.ParseErrors.Stats()[ParseErrType])
+}
+
+func TestStatsQ_HTTPMetrics(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log"}))
+	body := `[
+		{"bucket": "gorets", "type": "c", "value": 2, "sample_rate": 0.5, "dimensions": {"host": "a"}},
+		{"bucket": "gaugor", "type": "gauge", "value": -3},
+		{"bucket": "gaugor", "type": "g", "value": "+4"},
+		{"bucket": "glork", "type": "timer", "value": "320"},
+		{"bucket": "uniques", "type": "s", "value": 765},
+		{"bucket": "users", "type": "set", "value": "alice"}
+	]`
+	code, res := postHTTP(&sd, "/v1/metrics", body, false)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HTTPResult{Accepted: 6}, res)
+	pkts := drainPackets(&sd)
+	assert.Len(t, pkts, 6)
+	assert.Equal(t, &qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 2, Modifier: "c", Sampling: 0.5, Dimensions: qtypes.NewDimensionsPre(map[string]string{"host": "a"})}, pkts[0])
+	assert.Equal(t, float64(-3), pkts[1].ValFlt)
+	assert.Equal(t, "", pkts[1].ValStr)
+	assert.Equal(t, float64(4), pkts[2].ValFlt)
+	assert.Equal(t, "+", pkts[2].ValStr)
+	assert.Equal(t, "ms", pkts[3].Modifier)
+	assert.Equal(t, float64(320), pkts[3].ValFlt)
+	assert.Equal(t, "765", pkts[4].ValStr)
+	assert.Equal(t, "alice", pkts[5].ValStr)
+
+	body = `[
+		{"bucket": "gorets", "type": "c", "value": 1},
+		{"bucket": "", "type": "c", "value": 1},
+		{"bucket": "gorets", "type": "histogram", "value": 1},
+		{"bucket": "gorets", "type": "c", "value": "x"},
+		{"bucket": "gorets", "type": "c", "value": "NaN"},
+		{"bucket": "glork", "type": "ms", "value": "Inf"},
+		{"bucket": "gaugor", "type": "g", "value": "+Inf"},
+		{"bucket": "gorets", "type": "c"},
+		{"bucket": "gorets", "type": "c", "value": 1, "sample_rate": 0},
+		{"bucket": "gorets", "type": "c", "value": 1, "dimensions": {"": "a"}},
+		{"bucket": 1}
+	]`
+	code, res = postHTTP(&sd, "/v1/metrics", body, false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Len(t, drainPackets(&sd), 1)
+	classes := []string{}
+	for i, he := range res.Errors {
+		assert.Equal(t, i+1, *he.Index)
+		classes = append(classes, he.Class)
+	}
+	assert.Equal(t, []string{ParseErrMalformed, ParseErrType, ParseErrValue, ParseErrValue, ParseErrValue, ParseErrValue, ParseErrValue, ParseErrSampleRate, ParseErrDimension, ParseErrMalformed}, classes)
+
+	code, res = postHTTP(&sd, "/v1/metrics", `{"bucket": "gorets"}`, false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "request", res.Errors[0].Class)
+}
+
+func TestStatsQ_HTTPRequestErrors(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log", "http-max-body": "64"}))
+	code, _ := postHTTP(&sd, "/v1/statsd", strings.Repeat("gorets:1|c\n", 5), false)
+	assert.Equal(t, http.StatusOK, code)
+	drainPackets(&sd)
+	code, res := postHTTP(&sd, "/v1/statsd", strings.Repeat("gorets:1|c\n", 10), false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, 0, res.Accepted)
+	// compresses well below the limit, but not once uncompressed
+	code, _ = postHTTP(&sd, "/v1/statsd", strings.Repeat("gorets:1|c\n", 100), true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Len(t, drainPackets(&sd), 0)
+
+	rec := httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/statsd", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	req := httptest.NewRequest(http.MethodPost, "/v1/statsd", strings.NewReader("gorets:1|c"))
+	req.Header.Set("Content-Encoding", "br")
+	rec = httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	req = httptest.NewRequest(http.MethodPost, "/v1/statsd", strings.NewReader("gorets:1|c"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
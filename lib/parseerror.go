@@ -0,0 +1,88 @@
+package statsq
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Classes of parse errors, counted separately.
+const (
+	// ParseErrMalformed is a line missing the ':' or '|' separators
+	ParseErrMalformed = "malformed"
+	// ParseErrType is an unknown type code
+	ParseErrType = "type"
+	// ParseErrValue is an empty value or one that is not a number
+	ParseErrValue = "value"
+	// ParseErrSampleRate is a sample rate that is not a number
+	ParseErrSampleRate = "sample_rate"
+	// ParseErrDimension is a dimension without '=' or with an empty key
+	ParseErrDimension = "dimension"
+)
+
+// ParseErrorClasses lists the classes of parse errors.
+var ParseErrorClasses = []string{ParseErrMalformed, ParseErrType, ParseErrValue, ParseErrSampleRate, ParseErrDimension}
+
+// ParseError is returned for a line that could not be parsed.
+type ParseError struct {
+	Class string
+	Msg   string
+	Line  string
+}
+
+// Sentinels to test the class of a parse error using errors.Is.
+var (
+	ErrMalformedLine = &ParseError{Class: ParseErrMalformed}
+	ErrBadType       = &ParseError{Class: ParseErrType}
+	ErrBadValue      = &ParseError{Class: ParseErrValue}
+	ErrBadSampleRate = &ParseError{Class: ParseErrSampleRate}
+	ErrBadDimension  = &ParseError{Class: ParseErrDimension}
+)
+
+func newParseError(class, msg string, line []byte) *ParseError {
+	return &ParseError{Class: class, Msg: msg, Line: string(line)}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s in line %q", e.Msg, e.Line)
+}
+
+// Is reports whether target is a parse error of the same class.
+func (e *ParseError) Is(target error) bool {
+	t, ok := target.(*ParseError)
+	return ok && t.Class == e.Class
+}
+
+// ParseErrorCounter counts parse errors by class, it is safe for concurrent use.
+type ParseErrorCounter struct {
+	counts map[string]*uint64
+}
+
+func NewParseErrorCounter() *ParseErrorCounter {
+	c := &ParseErrorCounter{counts: map[string]*uint64{}}
+	for _, class := range ParseErrorClasses {
+		c.counts[class] = new(uint64)
+	}
+	return c
+}
+
+// Add counts err by its class, errors that are no *ParseError count as malformed.
+func (c *ParseErrorCounter) Add(err error) {
+	class := ParseErrMalformed
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		if _, ok := c.counts[pe.Class]; ok {
+			class = pe.Class
+		}
+	}
+	atomic.AddUint64(c.counts[class], 1)
+}
+
+// Stats returns the errors per class since the last call.
+func (c *ParseErrorCounter) Stats() map[string]uint64 {
+	res := map[string]uint64{}
+	for class, cnt := range c.counts {
+		res[class] = atomic.SwapUint64(cnt, 0)
+	}
+	return res
+}
@@ -0,0 +1,37 @@
+package statsq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseError_Is(t *testing.T) {
+	err := newParseError(ParseErrValue, "invalid value 'x'", []byte("gorets:x|c"))
+	assert.True(t, errors.Is(err, ErrBadValue))
+	assert.False(t, errors.Is(err, ErrBadType))
+	wrapped := fmt.Errorf("from 127.0.0.1: %w", err)
+	assert.True(t, errors.Is(wrapped, ErrBadValue))
+	assert.Equal(t, `invalid value 'x' in line "gorets:x|c"`, err.Error())
+}
+
+func TestParseErrorCounter(t *testing.T) {
+	c := NewParseErrorCounter()
+	c.Add(newParseError(ParseErrValue, "", nil))
+	c.Add(newParseError(ParseErrValue, "", nil))
+	c.Add(fmt.Errorf("wrapped: %w", newParseError(ParseErrDimension, "", nil)))
+	c.Add(errors.New("something else"))
+	exp := map[string]uint64{
+		ParseErrMalformed:  1,
+		ParseErrType:       0,
+		ParseErrValue:      2,
+		ParseErrSampleRate: 0,
+		ParseErrDimension:  1,
+	}
+	assert.Equal(t, exp, c.Stats())
+	for class := range exp {
+		exp[class] = 0
+	}
+	assert.Equal(t, exp, c.Stats())
+}
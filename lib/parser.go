@@ -2,13 +2,20 @@ package statsq
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/qnib/qframe-types"
 	"io"
 	"log"
+	"math"
+	"net"
+	"os"
 	"strconv"
-	"strings"
 )
 
+// MAX_INTERNED_STRINGS bounds the strings interned by a parser
+const MAX_INTERNED_STRINGS = 100000
+
 type MsgParser struct {
 	reader           io.Reader
 	buffer           []byte
@@ -18,6 +25,13 @@ type MsgParser struct {
 	maxUdpPacketSize int
 	prefix           string
 	postfix          string
+	// graphite parses lines in the graphite plaintext format instead of statsd lines
+	graphite bool
+	// readBuf is the buffer reads go to, scratch is reused to build bucket names and
+	// interned maps byte sequences to the strings returned before
+	readBuf  []byte
+	scratch  []byte
+	interned map[string]string
 }
 
 func NewParser(reader io.Reader, partialReads, debug bool, maxUdpPacketSize int, prefix, postfix string) *MsgParser {
@@ -25,10 +39,13 @@ func NewParser(reader io.Reader, partialReads, debug bool, maxUdpPacketSize int,
 		reader, []byte{},
 		partialReads, false, debug,
 		maxUdpPacketSize,
-		prefix, postfix}
+		prefix, postfix, false,
+		nil, nil, nil}
 }
 
-func (mp *MsgParser) Next() (*qtypes.StatsdPacket, bool) {
+// Next returns the packet of the next line and whether there are more lines to come. If the line
+// is malformed, the packet is nil and the error a *ParseError.
+func (mp *MsgParser) Next() (*qtypes.StatsdPacket, bool, error) {
 	buf := mp.buffer
 
 	for {
@@ -36,11 +53,13 @@ func (mp *MsgParser) Next() (*qtypes.StatsdPacket, bool) {
 
 		if line != nil {
 			mp.buffer = rest
-			return mp.parseLine(line), true
+			sp, err := mp.parse(line)
+			return sp, true, err
 		}
 
 		if mp.done {
-			return mp.parseLine(rest), false
+			sp, err := mp.parse(rest)
+			return sp, false, err
 		}
 
 		idx := len(buf)
@@ -52,16 +71,23 @@ func (mp *MsgParser) Next() (*qtypes.StatsdPacket, bool) {
 		}
 		if cap(buf) >= end {
 			buf = buf[:end]
+		} else if cap(mp.readBuf) >= end {
+			// move the partial line to the front of the read buffer, the previous lines are parsed already
+			tmp := buf
+			buf = mp.readBuf[:end]
+			copy(buf, tmp)
 		} else {
 			tmp := buf
 			buf = make([]byte, end)
 			copy(buf, tmp)
+			mp.readBuf = buf
 		}
 
 		n, err := mp.reader.Read(buf[idx:])
 		buf = buf[:idx+n]
 		if err != nil {
-			if err != io.EOF {
+			// closed on shutdown
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrClosed) {
 				log.Printf("ERROR: %s", err)
 			}
 
@@ -70,22 +96,31 @@ func (mp *MsgParser) Next() (*qtypes.StatsdPacket, bool) {
 			line, rest = mp.lineFrom(buf)
 			if line != nil {
 				mp.buffer = rest
-				return mp.parseLine(line), len(rest) > 0
+				sp, err := mp.parse(line)
+				return sp, len(rest) > 0, err
 			}
 
 			if len(rest) > 0 {
-				return mp.parseLine(rest), false
+				sp, err := mp.parse(rest)
+				return sp, false, err
 			}
 
-			return nil, false
+			return nil, false, nil
 		}
 	}
 }
 
+// parse parses a line in the format of the parser.
+func (mp *MsgParser) parse(line []byte) (*qtypes.StatsdPacket, error) {
+	if mp.graphite {
+		return mp.parseGraphiteLine(line)
+	}
+	return mp.parseLine(line)
+}
+
 func (mp *MsgParser) lineFrom(input []byte) ([]byte, []byte) {
-	split := bytes.SplitAfterN(input, []byte("\n"), 2)
-	if len(split) == 2 {
-		return split[0][:len(split[0])-1], split[1]
+	if idx := bytes.IndexByte(input, '\n'); idx >= 0 {
+		return input[:idx], input[idx+1:]
 	}
 
 	if !mp.partialReads {
@@ -193,101 +228,167 @@ func (mp *MsgParser) parseLine(line []byte) *Packet {
 }
 
 */
-func (mp *MsgParser) parseLine(line []byte) *qtypes.StatsdPacket {
-	splitDim := bytes.SplitN(line, []byte{' '}, 3)
-	dims := qtypes.NewDimensions()
-	switch len(splitDim) {
-	case 2:
-		dims = qtypes.NewDimensionsFromBytes(splitDim[1])
+// parseLine parses a single line in one pass over the byte slice, without copying it. Bucket names,
+// dimension keys and dimension values are interned, so that a recurring series does not allocate.
+// An empty line returns neither a packet nor an error, a malformed one a *ParseError.
+func (mp *MsgParser) parseLine(line []byte) (*qtypes.StatsdPacket, error) {
+	if len(line) == 0 {
+		return nil, nil
 	}
-	line = splitDim[0]
-	split := bytes.SplitN(line, []byte{'|'}, 3)
-	if len(split) < 2 {
-		mp.logParseFail(line)
-		return nil
+	orig := line
+	// dimensions follow the first space, unless the line holds more than one
+	var dimBytes []byte
+	if idx := bytes.IndexByte(line, ' '); idx >= 0 {
+		if bytes.IndexByte(line[idx+1:], ' ') < 0 {
+			dimBytes = line[idx+1:]
+		}
+		line = line[:idx]
+	}
+	idx := bytes.IndexByte(line, '|')
+	if idx < 0 {
+		return nil, newParseError(ParseErrMalformed, "missing '|'", orig)
+	}
+	keyval, typeCode := line[:idx], line[idx+1:]
+	var rate []byte
+	if idx := bytes.IndexByte(typeCode, '|'); idx >= 0 {
+		typeCode, rate = typeCode[:idx], typeCode[idx+1:]
 	}
-
-	keyval := split[0]
-	typeCode := string(split[1])
 
 	sampling := float32(1)
-	if strings.HasPrefix(typeCode, "c") || strings.HasPrefix(typeCode, "ms") {
-		if len(split) == 3 && len(split[2]) > 0 {
-			switch {
-			case split[2][0] == '@':
-				f64, err := strconv.ParseFloat(string(split[2][1:]), 32)
-				if err != nil {
-					log.Printf("ERROR: failed to ParseFloat %s - %s", string(split[2][1:]), err)
-					return nil
-				}
-				sampling = float32(f64)
+	if bytes.HasPrefix(typeCode, []byte("c")) || bytes.HasPrefix(typeCode, []byte("ms")) {
+		if len(rate) > 0 && rate[0] == '@' {
+			f64, err := strconv.ParseFloat(string(rate[1:]), 32)
+			if err != nil {
+				return nil, newParseError(ParseErrSampleRate, fmt.Sprintf("invalid sample rate '%s'", rate[1:]), orig)
+			}
+			if !(f64 > 0 && f64 <= 1) {
+				return nil, newParseError(ParseErrSampleRate, fmt.Sprintf("sample rate '%s' is not within (0,1]", rate[1:]), orig)
 			}
+			sampling = float32(f64)
 		}
 	}
-	split = bytes.SplitN(keyval, []byte{':'}, 2)
-	if len(split) < 2 {
-		mp.logParseFail(line)
-		return nil
+	idx = bytes.IndexByte(keyval, ':')
+	if idx < 0 {
+		return nil, newParseError(ParseErrMalformed, "missing ':'", orig)
 	}
-	name := string(split[0])
-	val := split[1]
+	name, val := keyval[:idx], keyval[idx+1:]
 	if len(val) == 0 {
-		mp.logParseFail(line)
-		return nil
+		return nil, newParseError(ParseErrValue, "empty value", orig)
 	}
 
 	var (
 		err      error
 		floatval float64
 		strval   string
+		modifier string
 	)
 
-	switch typeCode {
+	switch string(typeCode) {
 	case "c":
+		modifier = "c"
 		floatval, err = strconv.ParseFloat(string(val), 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
-		}
 	case "g":
-		var s string
-
-		if val[0] == '+' || val[0] == '-' {
-			strval = string(val[0])
-			s = string(val[1:])
-		} else {
-			s = string(val)
-		}
-		floatval, err = strconv.ParseFloat(s, 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
+		modifier = "g"
+		s := val
+		switch val[0] {
+		case '+':
+			strval, s = "+", val[1:]
+		case '-':
+			strval, s = "-", val[1:]
 		}
+		floatval, err = strconv.ParseFloat(string(s), 64)
 	case "s":
+		modifier = "s"
 		strval = string(val)
 	case "ms":
+		modifier = "ms"
 		floatval, err = strconv.ParseFloat(string(val), 64)
-		if err != nil {
-			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
-			return nil
-		}
 	default:
-		log.Printf("ERROR: unrecognized type code %q", typeCode)
-		return nil
+		return nil, newParseError(ParseErrType, fmt.Sprintf("unknown type '%s'", typeCode), orig)
+	}
+	if err != nil {
+		return nil, newParseError(ParseErrValue, fmt.Sprintf("invalid value '%s'", val), orig)
+	}
+	if math.IsNaN(floatval) || math.IsInf(floatval, 0) {
+		return nil, newParseError(ParseErrValue, fmt.Sprintf("value '%s' is not finite", val), orig)
+	}
+	dims, ok := mp.dimensions(dimBytes)
+	if !ok {
+		return nil, newParseError(ParseErrDimension, fmt.Sprintf("invalid dimensions '%s'", dimBytes), orig)
 	}
 
 	return &qtypes.StatsdPacket{
-		Bucket:     sanitizeBucket(mp.prefix + string(name) + mp.postfix),
+		Bucket:     mp.bucket(name),
 		ValFlt:     floatval,
 		ValStr:     strval,
-		Modifier:   typeCode,
+		Modifier:   modifier,
 		Sampling:   sampling,
 		Dimensions: dims,
+	}, nil
+}
+
+// bucket sanitizes prefix+name+postfix in the scratch buffer and returns the interned result.
+func (mp *MsgParser) bucket(name []byte) string {
+	b := append(mp.scratch[:0], mp.prefix...)
+	b = append(b, name...)
+	b = append(b, mp.postfix...)
+	mp.scratch = b
+	return mp.intern(sanitizeBytes(b))
+}
+
+// sanitizeBytes works like sanitizeBucket, but in place.
+func sanitizeBytes(b []byte) []byte {
+	var bl int
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_':
+			b[bl] = c
+			bl++
+		case c == ' ':
+			b[bl] = '_'
+			bl++
+		case c == '/':
+			b[bl] = '-'
+			bl++
+		}
 	}
+	return b[:bl]
 }
 
-func (mp *MsgParser) logParseFail(line []byte) {
-	if mp.debug {
-		log.Printf("ERROR: failed to parse line: %q\n", string(line))
+// dimensions parses 'key1=val1,key2=val2'. A tuple without '=' or with an empty key is invalid.
+// The map itself is not reused, as it is handed on with the packet.
+func (mp *MsgParser) dimensions(inp []byte) (qtypes.Dimensions, bool) {
+	if len(inp) == 0 {
+		return qtypes.NewDimensions(), true
+	}
+	dims := qtypes.Dimensions{Map: make(map[string]string, bytes.Count(inp, []byte{','})+1)}
+	for last := false; !last; {
+		tupel := inp
+		if idx := bytes.IndexByte(inp, ','); idx >= 0 {
+			tupel, inp = inp[:idx], inp[idx+1:]
+		} else {
+			last = true
+		}
+		idx := bytes.IndexByte(tupel, '=')
+		if idx < 1 {
+			return dims, false
+		}
+		dims.Map[mp.intern(tupel[:idx])] = mp.intern(tupel[idx+1:])
+	}
+	return dims, true
+}
+
+// intern returns a string equal to b, reusing the one returned before if there is one. The table is
+// dropped once it holds MAX_INTERNED_STRINGS, so that high cardinality input does not grow it forever.
+func (mp *MsgParser) intern(b []byte) string {
+	if s, ok := mp.interned[string(b)]; ok {
+		return s
+	}
+	if mp.interned == nil || len(mp.interned) >= MAX_INTERNED_STRINGS {
+		mp.interned = make(map[string]string)
 	}
+	s := string(b)
+	mp.interned[s] = s
+	return s
 }
@@ -2,7 +2,15 @@ package statsq
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"github.com/qnib/qframe-types"
 )
@@ -18,7 +26,7 @@ func TestParseLineGauge(t *testing.T) {
 		debug: true,
 	}
 	d := []byte("gaugor:333|g")
-	packet := mp.parseLine(d)
+	packet, _ := mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(333), packet.ValFlt)
@@ -27,7 +35,7 @@ func TestParseLineGauge(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("gaugor:-10|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(10), packet.ValFlt)
@@ -36,7 +44,7 @@ func TestParseLineGauge(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("gaugor:+4|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
@@ -46,7 +54,7 @@ func TestParseLineGauge(t *testing.T) {
 
 	// >max(int64) && <max(uint64)
 	d = []byte("gaugor:18446744073709551606|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(18446744073709551606), packet.ValFlt)
@@ -56,7 +64,7 @@ func TestParseLineGauge(t *testing.T) {
 
 	// float values
 	d = []byte("gaugor:3.3333|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(3.3333), packet.ValFlt)
@@ -70,7 +78,7 @@ func TestParseLineCount(t *testing.T) {
 		debug: true,
 	}
 	d := []byte("gorets:2|c|@0.1")
-	packet := mp.parseLine(d)
+	packet, _ := mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(2), packet.ValFlt)
@@ -78,7 +86,7 @@ func TestParseLineCount(t *testing.T) {
 	assert.Equal(t, float32(0.1), packet.Sampling)
 
 	d = []byte("gorets:4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
@@ -86,7 +94,7 @@ func TestParseLineCount(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("gorets:-4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(-4), packet.ValFlt)
@@ -94,7 +102,7 @@ func TestParseLineCount(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("gorets:1.25|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, 1.25, packet.ValFlt)
@@ -107,7 +115,7 @@ func TestParseLineTimer(t *testing.T) {
 		debug: true,
 	}
 	d := []byte("glork:320|ms")
-	packet := mp.parseLine(d)
+	packet, _ := mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "glork", packet.Bucket)
 	assert.Equal(t, float64(320), packet.ValFlt)
@@ -115,7 +123,7 @@ func TestParseLineTimer(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("glork:320|ms|@0.1")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "glork", packet.Bucket)
 	assert.Equal(t, float64(320), packet.ValFlt)
@@ -123,7 +131,7 @@ func TestParseLineTimer(t *testing.T) {
 	assert.Equal(t, float32(0.1), packet.Sampling)
 
 	d = []byte("glork:3.7211|ms")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "glork", packet.Bucket)
 	assert.Equal(t, float64(3.7211), packet.ValFlt)
@@ -136,7 +144,7 @@ func TestParseLineSet(t *testing.T) {
 		debug: true,
 	}
 	d := []byte("uniques:765|s")
-	packet := mp.parseLine(d)
+	packet, _ := mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "uniques", packet.Bucket)
 	assert.Equal(t, "765", packet.ValStr)
@@ -150,7 +158,7 @@ func TestParseLineMisc(t *testing.T) {
 	}
 
 	d := []byte("a.key.with-0.dash:4|c")
-	packet := mp.parseLine(d)
+	packet, _ := mp.parseLine(d)
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
@@ -159,14 +167,14 @@ func TestParseLineMisc(t *testing.T) {
 
 
 	d = []byte("a.key.with/0.slash:4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.Equal(t, "a.key.with-0.slash", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
 	assert.Equal(t, "c", packet.Modifier)
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("a.key.with@#*&%$^_0.garbage:4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.Equal(t, "a.key.with_0.garbage", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
 	assert.Equal(t, "c", packet.Modifier)
@@ -174,7 +182,7 @@ func TestParseLineMisc(t *testing.T) {
 
 	mp.prefix = "test."
 	d = []byte("prefix:4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.Equal(t, "test.prefix", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
 	assert.Equal(t, "c", packet.Modifier)
@@ -182,7 +190,7 @@ func TestParseLineMisc(t *testing.T) {
 	mp.prefix = ""
 	mp.postfix = ".test"
 	d = []byte("postfix:4|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	assert.Equal(t, "postfix.test", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
 	assert.Equal(t, "c", packet.Modifier)
@@ -191,14 +199,14 @@ func TestParseLineMisc(t *testing.T) {
 
 	d = []byte("a.key.with-0.dash:4|c\ngauge:3|g")
 	parser := NewParser(bytes.NewBuffer(d), true, mp.debug, mp.maxUdpPacketSize, mp.prefix, mp.postfix)
-	packet, more := parser.Next()
+	packet, more, _ := parser.Next()
 	assert.Equal(t, more, true)
 	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
 	assert.Equal(t, float64(4), packet.ValFlt)
 	assert.Equal(t, "c", packet.Modifier)
 	assert.Equal(t, float32(1), packet.Sampling)
 
-	packet, more = parser.Next()
+	packet, more, _ = parser.Next()
 	assert.Equal(t, more, false)
 	assert.Equal(t, "gauge", packet.Bucket)
 	assert.Equal(t, 3.0, packet.ValFlt)
@@ -207,85 +215,85 @@ func TestParseLineMisc(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 
 	d = []byte("a.key.with-0.dash:4\ngauge3|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("a.key.with-0.dash:4")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets:5m")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets:")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets:5|mg")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets:5|ms|@")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gorets:xxx|c")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gaugor:xxx|g")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("gaugor:xxx|z")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("deploys.test.myservice4:100|t")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("up-to-colon:")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
 
 	d = []byte("up-to-pipe:1|")
-	packet = mp.parseLine(d)
+	packet, _ = mp.parseLine(d)
 	if packet != nil {
 		t.Fail()
 	}
@@ -297,7 +305,7 @@ func TestMultiLine(t *testing.T) {
 	}
 	b := bytes.NewBuffer([]byte("a.key.with-0.dash:4|c\ngauge:3|g"))
 	parser := NewParser(b, true, mp.debug, mp.maxUdpPacketSize, mp.prefix, mp.postfix)
-	packet, more := parser.Next()
+	packet, more, _ := parser.Next()
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, more, true)
 	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
@@ -305,7 +313,7 @@ func TestMultiLine(t *testing.T) {
 	assert.Equal(t, "c", packet.Modifier)
 	assert.Equal(t, float32(1), packet.Sampling)
 
-	packet, more = parser.Next()
+	packet, more, _ = parser.Next()
 	assert.NotEqual(t, packet, nil)
 	assert.Equal(t, more, false)
 	assert.Equal(t, "gauge", packet.Bucket)
@@ -323,7 +331,7 @@ func TestParseLineSdPktGauge(t *testing.T) {
 		debug: true,
 	}
 	d := []byte("gaugor:333|g")
-	sp := mp.parseLine(d)
+	sp, _ := mp.parseLine(d)
 	assert.NotEqual(t, sp, nil)
 	assert.Equal(t, "gaugor", sp.Bucket)
 	assert.Equal(t, float64(333), sp.ValFlt)
@@ -334,17 +342,17 @@ func TestParseLineSdPktGauge(t *testing.T) {
 
 	dims := qtypes.NewDimensionsPre(map[string]string{"key1":"val1"})
 	d = []byte("gaugor:333|g key1=val1")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.Equal(t, dims, sp.Dimensions)
 
 	dims.Add("key2", "val2")
 	d = []byte("gaugor:333|g key1=val1,key2=val2")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.Equal(t, dims, sp.Dimensions)
 
 
 	d = []byte("gaugor:-10|g")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.NotEqual(t, sp, nil)
 	assert.Equal(t, "gaugor", sp.Bucket)
 	assert.Equal(t, float64(10), sp.ValFlt)
@@ -353,7 +361,7 @@ func TestParseLineSdPktGauge(t *testing.T) {
 	assert.Equal(t, float32(1), sp.Sampling)
 
 	d = []byte("gaugor:+4|g")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.NotEqual(t, sp, nil)
 	assert.Equal(t, "gaugor", sp.Bucket)
 	assert.Equal(t, float64(4), sp.ValFlt)
@@ -363,7 +371,7 @@ func TestParseLineSdPktGauge(t *testing.T) {
 
 	// >max(int64) && <max(uint64)
 	d = []byte("gaugor:18446744073709551606|g")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.NotEqual(t, sp, nil)
 	assert.Equal(t, "gaugor", sp.Bucket)
 	assert.Equal(t, float64(18446744073709551606), sp.ValFlt)
@@ -373,7 +381,7 @@ func TestParseLineSdPktGauge(t *testing.T) {
 
 	// float values
 	d = []byte("gaugor:3.3333|g")
-	sp = mp.parseLine(d)
+	sp, _ = mp.parseLine(d)
 	assert.NotEqual(t, sp, nil)
 	assert.Equal(t, "gaugor", sp.Bucket)
 	assert.Equal(t, float64(3.3333), sp.ValFlt)
@@ -381,3 +389,344 @@ func TestParseLineSdPktGauge(t *testing.T) {
 	assert.Equal(t, "g", sp.Modifier)
 	assert.Equal(t, float32(1), sp.Sampling)
 }
+
+// parserTestLines holds the lines of the tests above, used as corpus to compare the parser with legacyParseLine.
+var parserTestLines = []string{
+	"gaugor:333|g", "gaugor:-10|g", "gaugor:+4|g", "gaugor:18446744073709551606|g", "gaugor:3.3333|g",
+	"gorets:2|c|@0.1", "gorets:4|c", "gorets:-4|c", "gorets:1.25|c",
+	"glork:320|ms", "glork:320|ms|@0.1", "glork:3.7211|ms",
+	"uniques:765|s",
+	"a.key.with-0.dash:4|c", "a.key.with/0.slash:4|c", "a.key.with@#*&%$^_0.garbage:4|c", "prefix:4|c", "postfix:4|c",
+	"a.key.with-0.dash:4\ngauge3|g", "a.key.with-0.dash:4", "gorets:5m", "gorets", "gorets:", "gorets:5|mg",
+	"gorets:5|ms|@", "", "gorets:xxx|c", "gaugor:xxx|g", "gaugor:xxx|z", "deploys.test.myservice4:100|t",
+	"up-to-colon:", "up-to-pipe:1|",
+	"gaugor:333|g key1=val1", "gaugor:333|g key1=val1,key2=val2",
+	"gaugor:333|g ", "gaugor:333|g key1=val1,", "gaugor:333|g key1=val1,novalue,key2=val2", "gaugor:333|g key=a=b",
+	"gaugor:333|g key1=val1 key2=val2", "gorets:1|c|@0.5|extra", "gorets:1|c|0.5", "some bucket:1|c",
+}
+
+// samePacket compares two packets, treating NaN values as equal.
+func samePacket(a, b *qtypes.StatsdPacket) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ca, cb := *a, *b
+	if math.IsNaN(ca.ValFlt) && math.IsNaN(cb.ValFlt) {
+		ca.ValFlt, cb.ValFlt = 0, 0
+	}
+	if math.IsNaN(float64(ca.Sampling)) && math.IsNaN(float64(cb.Sampling)) {
+		ca.Sampling, cb.Sampling = 0, 0
+	}
+	return reflect.DeepEqual(ca, cb)
+}
+
+// finitePacket reports whether the value of sp is finite and its sample rate within (0,1].
+func finitePacket(sp *qtypes.StatsdPacket) bool {
+	return !math.IsNaN(sp.ValFlt) && !math.IsInf(sp.ValFlt, 0) && sp.Sampling > 0 && sp.Sampling <= 1
+}
+
+// compareLegacy checks parseLine against legacyParseLine. The legacy parser stops at the first invalid dimension,
+// instead of rejecting the line, and accepts values that are not finite as well as any sample rate.
+func compareLegacy(mp *MsgParser, line []byte) error {
+	exp := legacyParseLine(mp, line)
+	got, err := mp.parseLine(line)
+	var pe *ParseError
+	switch {
+	case err != nil && !errors.As(err, &pe):
+		return fmt.Errorf("%q: expected a *ParseError, got %v", line, err)
+	case err != nil && got != nil:
+		return fmt.Errorf("%q: got a packet along with %v", line, err)
+	case err == nil && got == nil && len(line) > 0:
+		return fmt.Errorf("%q: got neither a packet nor an error", line)
+	case errors.Is(err, ErrBadDimension):
+		return nil
+	case (errors.Is(err, ErrBadValue) || errors.Is(err, ErrBadSampleRate)) && exp != nil && !finitePacket(exp):
+		return nil
+	case !samePacket(exp, got):
+		return fmt.Errorf("%q: expected %+v, got %+v (%v)", line, exp, got, err)
+	}
+	return nil
+}
+
+func TestParseLineLegacy(t *testing.T) {
+	for _, mp := range []*MsgParser{{}, {prefix: "pre fix.", postfix: "/post"}} {
+		for _, line := range parserTestLines {
+			// twice, the second time from the interned strings
+			for i := 0; i < 2; i++ {
+				assert.NoError(t, compareLegacy(mp, []byte(line)))
+			}
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	mp := NewMP()
+	cases := map[string]error{
+		"gorets":                            ErrMalformedLine,
+		"gorets:5m":                         ErrMalformedLine,
+		"gorets|c":                          ErrMalformedLine,
+		"gorets:|c":                         ErrBadValue,
+		"gorets:xxx|c":                      ErrBadValue,
+		"gaugor:+|g":                        ErrBadValue,
+		"gaugor:-|g":                        ErrBadValue,
+		"glork:1|ms|@":                      ErrBadSampleRate,
+		"gorets:1|c|@x":                     ErrBadSampleRate,
+		"gorets:1|c|@0":                     ErrBadSampleRate,
+		"gorets:1|c|@-0.5":                  ErrBadSampleRate,
+		"gorets:1|c|@1.5":                   ErrBadSampleRate,
+		"glork:1|ms|@NaN":                   ErrBadSampleRate,
+		"gorets:NaN|c":                      ErrBadValue,
+		"glork:+Inf|ms":                     ErrBadValue,
+		"gaugor:-Inf|g":                     ErrBadValue,
+		"gaugor:+NaN|g":                     ErrBadValue,
+		"gorets:5|mg":                       ErrBadType,
+		"up-to-pipe:1|":                     ErrBadType,
+		"gaugor:1|g host":                   ErrBadDimension,
+		"gaugor:1|g host=a,":                ErrBadDimension,
+		"gaugor:1|g =a":                     ErrBadDimension,
+		"gaugor:1|g host=a,service,env=dev": ErrBadDimension,
+	}
+	for line, exp := range cases {
+		sp, err := mp.parseLine([]byte(line))
+		assert.Nil(t, sp, line)
+		assert.True(t, errors.Is(err, exp), "%q: expected %v, got %v", line, exp.(*ParseError).Class, err)
+		assert.Contains(t, err.Error(), strconv.Quote(line))
+	}
+	sp, err := mp.parseLine([]byte("gaugor:1|g host=a=b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a=b", sp.Dimensions.Map["host"])
+	sp, err = mp.parseLine([]byte{})
+	assert.Nil(t, sp)
+	assert.NoError(t, err)
+}
+
+func TestParseLineAllocs(t *testing.T) {
+	mp := NewMP()
+	d := []byte("a.key.with-0.dash:4|c|@0.5")
+	mp.parseLine(d)
+	// the packet and its dimensions map
+	assert.Equal(t, float64(2), testing.AllocsPerRun(100, func() { mp.parseLine(d) }))
+	d = []byte("gaugor:333|g key1=val1,key2=val2")
+	mp.parseLine(d)
+	assert.True(t, testing.AllocsPerRun(100, func() { mp.parseLine(d) }) <= 3)
+}
+
+func TestMsgParser_NextReusesBuffer(t *testing.T) {
+	r := &lineReader{lines: []string{"gorets:1|c", "gaugor:2|g"}}
+	mp := NewParser(r, false, false, DEFAULT_MAX_UDP_PACKET_SIZE, "", "")
+	sp, more, err := mp.Next()
+	assert.NoError(t, err)
+	assert.True(t, more)
+	assert.Equal(t, "gorets", sp.Bucket)
+	buf := mp.readBuf
+	sp, _, _ = mp.Next()
+	assert.Equal(t, "gaugor", sp.Bucket)
+	assert.Equal(t, &buf[0], &mp.readBuf[0])
+}
+
+func TestMsgParser_NextErrors(t *testing.T) {
+	b := bytes.NewBufferString("gorets:1|c\ngorets:x|c\n\ngaugor:2|g")
+	mp := NewParser(b, true, false, 0, "", "")
+	sp, more, err := mp.Next()
+	assert.NoError(t, err)
+	assert.True(t, more)
+	assert.Equal(t, "gorets", sp.Bucket)
+	sp, more, err = mp.Next()
+	assert.True(t, errors.Is(err, ErrBadValue))
+	assert.Nil(t, sp)
+	assert.True(t, more)
+	// the empty line
+	sp, more, err = mp.Next()
+	assert.NoError(t, err)
+	assert.Nil(t, sp)
+	sp, more, err = mp.Next()
+	assert.NoError(t, err)
+	assert.False(t, more)
+	assert.Equal(t, "gaugor", sp.Bucket)
+}
+
+// lineReader returns one line per Read call, like a UDP socket.
+type lineReader struct {
+	lines []string
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[0])
+	r.lines = r.lines[1:]
+	return n, nil
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, line := range parserTestLines {
+		f.Add([]byte(line), "")
+	}
+	f.Add([]byte("gorets:1|c"), "pre/fix ")
+	f.Fuzz(func(t *testing.T, line []byte, prefix string) {
+		if err := compareLegacy(&MsgParser{prefix: prefix, postfix: prefix}, line); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzMsgParserNext checks that reading a stream returns the same packets and errors as parsing it line by line.
+func FuzzMsgParserNext(f *testing.F) {
+	f.Add([]byte(strings.Join(parserTestLines, "\n")), true)
+	f.Add([]byte(strings.Join(parserTestLines, "\n")), false)
+	f.Add([]byte(strings.Repeat("gorets:1|c host=a\n", 1000)), true)
+	f.Fuzz(func(t *testing.T, data []byte, partialReads bool) {
+		exp := &MsgParser{}
+		lines := bytes.Split(data, []byte{'\n'})
+		mp := NewParser(bytes.NewReader(data), partialReads, false, len(data)+1, "", "")
+		more := true
+		for i, line := range lines {
+			if i == len(lines)-1 && len(line) == 0 {
+				break
+			}
+			// copy the line, the parser reads into its own buffer
+			expSp, expErr := exp.parseLine(append([]byte{}, line...))
+			var sp *qtypes.StatsdPacket
+			var err error
+			sp, more, err = mp.Next()
+			if !samePacket(expSp, sp) || fmt.Sprint(expErr) != fmt.Sprint(err) {
+				t.Fatalf("line %d %q: expected %+v (%v), got %+v (%v)", i, line, expSp, expErr, sp, err)
+			}
+			if !more && i < len(lines)-1 && !(i == len(lines)-2 && len(lines[i+1]) == 0) {
+				t.Fatalf("line %d %q: no more lines", i, line)
+			}
+		}
+		// the end of the stream might be detected only by the next call
+		for i := 0; more && i < 2; i++ {
+			var sp *qtypes.StatsdPacket
+			var err error
+			sp, more, err = mp.Next()
+			if sp != nil || err != nil {
+				t.Fatalf("expected the end of the stream, got %+v (%v)", sp, err)
+			}
+		}
+	})
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	lines := [][]byte{
+		[]byte("a.key.with-0.dash:4|c|@0.5"),
+		[]byte("gaugor.whatever:-5|g"),
+		[]byte("glork.some.keyspace:3.7211|ms"),
+		[]byte("setof.some.keyspace:hiya|s"),
+		[]byte("gaugor.whatever:333.4|g host=web01,service=api"),
+	}
+	parsers := []struct {
+		name  string
+		parse func(*MsgParser, []byte) *qtypes.StatsdPacket
+	}{
+		{"scanner", func(mp *MsgParser, line []byte) *qtypes.StatsdPacket {
+			sp, _ := mp.parseLine(line)
+			return sp
+		}},
+		{"legacy", legacyParseLine},
+	}
+	for _, p := range parsers {
+		b.Run(p.name, func(b *testing.B) {
+			mp := NewMP()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, d := range lines {
+					p.parse(&mp, d)
+				}
+			}
+		})
+	}
+}
+
+// legacyParseLine is the former parser, kept to check the single-pass one against it.
+func legacyParseLine(mp *MsgParser, line []byte) *qtypes.StatsdPacket {
+	splitDim := bytes.SplitN(line, []byte{' '}, 3)
+	dims := qtypes.NewDimensions()
+	switch len(splitDim) {
+	case 2:
+		dims = qtypes.NewDimensionsFromBytes(splitDim[1])
+	}
+	line = splitDim[0]
+	split := bytes.SplitN(line, []byte{'|'}, 3)
+	if len(split) < 2 {
+		return nil
+	}
+
+	keyval := split[0]
+	typeCode := string(split[1])
+
+	sampling := float32(1)
+	if strings.HasPrefix(typeCode, "c") || strings.HasPrefix(typeCode, "ms") {
+		if len(split) == 3 && len(split[2]) > 0 {
+			switch {
+			case split[2][0] == '@':
+				f64, err := strconv.ParseFloat(string(split[2][1:]), 32)
+				if err != nil {
+					log.Printf("ERROR: failed to ParseFloat %s - %s", string(split[2][1:]), err)
+					return nil
+				}
+				sampling = float32(f64)
+			}
+		}
+	}
+	split = bytes.SplitN(keyval, []byte{':'}, 2)
+	if len(split) < 2 {
+		return nil
+	}
+	name := string(split[0])
+	val := split[1]
+	if len(val) == 0 {
+		return nil
+	}
+
+	var (
+		err      error
+		floatval float64
+		strval   string
+	)
+
+	switch typeCode {
+	case "c":
+		floatval, err = strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
+			return nil
+		}
+	case "g":
+		var s string
+
+		if val[0] == '+' || val[0] == '-' {
+			strval = string(val[0])
+			s = string(val[1:])
+		} else {
+			s = string(val)
+		}
+		floatval, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
+			return nil
+		}
+	case "s":
+		strval = string(val)
+	case "ms":
+		floatval, err = strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			log.Printf("ERROR: failed to ParseFloat %s - %s", string(val), err)
+			return nil
+		}
+	default:
+		log.Printf("ERROR: unrecognized type code %q", typeCode)
+		return nil
+	}
+
+	return &qtypes.StatsdPacket{
+		Bucket:     sanitizeBucket(mp.prefix + string(name) + mp.postfix),
+		ValFlt:     floatval,
+		ValStr:     strval,
+		Modifier:   typeCode,
+		Sampling:   sampling,
+		Dimensions: dims,
+	}
+}
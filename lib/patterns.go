@@ -0,0 +1,91 @@
+package statsq
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BucketPatterns matches bucket names against a list of regular expressions.
+type BucketPatterns []*regexp.Regexp
+
+// NewBucketPatterns compiles a comma separated list of regular expressions.
+func NewBucketPatterns(s string) (BucketPatterns, error) {
+	bp := BucketPatterns{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return bp, err
+		}
+		bp = append(bp, re)
+	}
+	return bp, nil
+}
+
+// Match returns true if any of the patterns matches the bucket.
+func (bp BucketPatterns) Match(bucket string) bool {
+	for _, re := range bp {
+		if re.MatchString(bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies to aggregate the absolute values a gauge receives within an interval.
+const (
+	GaugeLast  = "last"
+	GaugeFirst = "first"
+	GaugeMin   = "min"
+	GaugeMax   = "max"
+	GaugeAvg   = "avg"
+	GaugeSum   = "sum"
+)
+
+// GaugePolicies are configured by gauge-<policy> bucket patterns, the first matching policy is used.
+// Gauges not matching any pattern keep the last value.
+var GaugePolicies = []string{GaugeFirst, GaugeMin, GaugeMax, GaugeAvg, GaugeSum}
+
+// BucketOptions holds the settings of a bucket that are selected by bucket patterns.
+// They are resolved once per BucketID, as matching the patterns for every packet is too costly.
+type BucketOptions struct {
+	TimerSketch bool
+	SetHLL      bool
+	GaugePolicy string
+	// GaugeResend is the number of intervals the last value of an inactive gauge is resent
+	GaugeResend int
+	// GaugeDelete drops a gauge once it is sent, so that relative updates start from 0
+	GaugeDelete bool
+}
+
+// bucketPatterns reads the patterns from the config, logging errors.
+func (sd *StatsQ) bucketPatterns(path string) BucketPatterns {
+	bp, err := NewBucketPatterns(sd.String(path))
+	if err != nil {
+		sd.invalidSetting("error", fmt.Sprintf("Invalid bucket pattern in '%s': %s", path, err.Error()))
+	}
+	return bp
+}
+
+// OptionsFor returns the options for the bucket.
+func (sd *StatsQ) OptionsFor(bucket string) BucketOptions {
+	opts := BucketOptions{
+		TimerSketch: sd.SketchPatterns.Match(bucket),
+		SetHLL:      sd.HLLPatterns.Match(bucket),
+		GaugePolicy: GaugeLast,
+		GaugeResend: sd.GaugeResendFor(bucket),
+	}
+	// delete-gauges only applies to gauges that are sent once, not if resending is configured otherwise
+	opts.GaugeDelete = sd.deleteGauges && opts.GaugeResend == 0
+	for _, policy := range GaugePolicies {
+		if sd.GaugePatterns[policy].Match(bucket) {
+			opts.GaugePolicy = policy
+			break
+		}
+	}
+	return opts
+}
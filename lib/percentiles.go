@@ -2,10 +2,21 @@ package statsq
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
 
+// Methods to calculate a percentile out of the sorted samples of a timer.
+const (
+	// PercentileNearestRank picks the sample at the rounded rank (the statsd default)
+	PercentileNearestRank = "nearest-rank"
+	// PercentileLinear interpolates the empirical distribution function linearly (Hyndman-Fan type 4)
+	PercentileLinear = "linear"
+	// PercentileHF7 interpolates between the closest ranks (Hyndman-Fan type 7, the default of R and numpy)
+	PercentileHF7 = "hf7"
+)
+
 type Percentiles []*Percentile
 
 type Percentile struct {
@@ -13,11 +24,15 @@ type Percentile struct {
 	str   string
 }
 
+// Set parses a percentile, negative values calculate lower percentiles (e.g. -10 for lower_10).
 func (a *Percentiles) Set(s string) error {
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
 		return err
 	}
+	if f <= -100 || f >= 100 {
+		return fmt.Errorf("percentile %s not in (-100,100)", s)
+	}
 	*a = append(*a, &Percentile{f, strings.Replace(s, ".", "_", -1)})
 	return nil
 }
@@ -27,3 +42,60 @@ func (p *Percentile) String() string {
 func (a *Percentiles) String() string {
 	return fmt.Sprintf("%v", *a)
 }
+
+// IsPercentileMethod returns true if method is known.
+func IsPercentileMethod(method string) bool {
+	switch method {
+	case PercentileNearestRank, PercentileLinear, PercentileHF7:
+		return true
+	}
+	return false
+}
+
+// Value returns the percentile of the sorted samples, calculated using method.
+func (p *Percentile) Value(sorted []float64, method string) float64 {
+	count := len(sorted)
+	if count == 0 {
+		return math.NaN()
+	}
+	abs := p.float
+	if p.float < 0 {
+		abs = 100 + p.float
+	}
+	q := abs / 100.0
+	switch method {
+	case PercentileLinear:
+		return interpolate(sorted, q*float64(count)-1)
+	case PercentileHF7:
+		return interpolate(sorted, q*float64(count-1))
+	}
+	// poor man's math.Round(x):
+	// math.Floor(x + 0.5)
+	indexOfPerc := int(math.Floor((q * float64(count)) + 0.5))
+	if p.float >= 0 {
+		indexOfPerc -= 1 // index offset=0
+	}
+	return sorted[clampIndex(indexOfPerc, count)]
+}
+
+// interpolate returns the value at the fractional, zero based index h.
+func interpolate(sorted []float64, h float64) float64 {
+	if h <= 0 {
+		return sorted[0]
+	}
+	lo := int(math.Floor(h))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+func clampIndex(idx, count int) int {
+	if idx < 0 {
+		return 0
+	}
+	if idx >= count {
+		return count - 1
+	}
+	return idx
+}
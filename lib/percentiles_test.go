@@ -2,7 +2,12 @@ package statsq
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
 	"testing"
+	"testing/quick"
 )
 
 func TestPercentiles_Set(t *testing.T) {
@@ -13,6 +18,12 @@ func TestPercentiles_Set(t *testing.T) {
 	err = p.Set("fail")
 	assert.Error(t, err)
 	assert.Equal(t, "[90]", p.String())
+	assert.Error(t, p.Set("100"))
+	assert.Error(t, p.Set("-100"))
+	assert.Error(t, p.Set("250"))
+	assert.NoError(t, p.Set("99.9"))
+	assert.NoError(t, p.Set("-0.1"))
+	assert.Equal(t, "[90 99_9 -0_1]", p.String())
 }
 
 func TestPercentile_Sring(t *testing.T) {
@@ -22,3 +33,89 @@ func TestPercentile_Sring(t *testing.T) {
 	}
 	assert.Equal(t, "90", p.String())
 }
+
+func TestPercentile_Value(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40}
+	cases := []struct {
+		pct    float64
+		method string
+		exp    float64
+	}{
+		{75, PercentileNearestRank, 30},
+		{-75, PercentileNearestRank, 20},
+		{1, PercentileNearestRank, 10},
+		{-0.1, PercentileNearestRank, 40},
+		{50, PercentileLinear, 20},
+		{75, PercentileLinear, 30},
+		{90, PercentileLinear, 36},
+		{10, PercentileLinear, 10},
+		{50, PercentileHF7, 25},
+		{90, PercentileHF7, 37},
+		{-90, PercentileHF7, 13},
+		{99.9, PercentileHF7, 39.97},
+	}
+	for _, c := range cases {
+		p := Percentile{float: c.pct}
+		assert.InDelta(t, c.exp, p.Value(sorted, c.method), 1e-9, "%v with %s", c.pct, c.method)
+	}
+	p := Percentile{float: 90}
+	assert.Equal(t, float64(5), p.Value([]float64{5}, PercentileHF7))
+	assert.True(t, math.IsNaN(p.Value([]float64{}, PercentileHF7)))
+}
+
+// randomSamples generates sorted samples and a percentile in (-100,100) for property based tests.
+type randomSamples struct {
+	sorted []float64
+	pct    float64
+}
+
+func (randomSamples) Generate(r *rand.Rand, size int) reflect.Value {
+	n := 1 + r.Intn(200)
+	sorted := make([]float64, n)
+	for i := range sorted {
+		sorted[i] = r.NormFloat64() * 100
+	}
+	sort.Float64s(sorted)
+	pct := r.Float64()*199.998 - 99.999
+	return reflect.ValueOf(randomSamples{sorted, pct})
+}
+
+func TestPercentile_ValueProperties(t *testing.T) {
+	for _, method := range []string{PercentileNearestRank, PercentileLinear, PercentileHF7} {
+		// the percentile is within the range of the samples
+		inRange := func(rs randomSamples) bool {
+			p := Percentile{float: rs.pct}
+			v := p.Value(rs.sorted, method)
+			return v >= rs.sorted[0] && v <= rs.sorted[len(rs.sorted)-1]
+		}
+		assert.NoError(t, quick.Check(inRange, nil), method)
+		// a higher percentile never yields a smaller value
+		monotonic := func(rs randomSamples) bool {
+			if rs.pct < 0 {
+				return true
+			}
+			p := Percentile{float: rs.pct}
+			h := Percentile{float: rs.pct + (100-rs.pct)/2}
+			return p.Value(rs.sorted, method) <= h.Value(rs.sorted, method)
+		}
+		assert.NoError(t, quick.Check(monotonic, nil), method)
+	}
+	// nearest rank always picks one of the samples
+	isSample := func(rs randomSamples) bool {
+		p := Percentile{float: rs.pct}
+		v := p.Value(rs.sorted, PercentileNearestRank)
+		i := sort.SearchFloat64s(rs.sorted, v)
+		return i < len(rs.sorted) && rs.sorted[i] == v
+	}
+	assert.NoError(t, quick.Check(isSample, nil))
+}
+
+func TestNewStatsQPercentileMethod(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"percentiles": "90,100,x"}))
+	assert.Equal(t, PercentileNearestRank, sd.PercentileMethod)
+	assert.Equal(t, "[90]", sd.Percentiles.String())
+	sd = NewStatsQ(NewPreCfg(map[string]string{"percentile-method": "hf7"}))
+	assert.Equal(t, PercentileHF7, sd.PercentileMethod)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"percentile-method": "median-of-medians"}))
+	assert.Equal(t, PercentileNearestRank, sd.PercentileMethod)
+}
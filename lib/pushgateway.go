@@ -0,0 +1,176 @@
+package statsq
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ParseGroupingKey returns the grouping labels of a Pushgateway URL path (/metrics/job/<job>{/<label>/<value>}),
+// decoding the values of labels with an '@base64' suffix.
+func ParseGroupingKey(path string) (map[string]string, error) {
+	rest := strings.TrimPrefix(path, "/metrics/")
+	if rest == path {
+		return nil, fmt.Errorf("'%s' does not start with /metrics/", path)
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("grouping key '%s' has a label without value", rest)
+	}
+	labels := map[string]string{}
+	for i := 0; i < len(parts); i += 2 {
+		name, val := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			dec, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(val, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of label '%s': %s", name, err.Error())
+			}
+			val = string(dec)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("grouping key '%s' has an empty label name", rest)
+		}
+		labels[name] = val
+	}
+	if labels["job"] == "" {
+		return nil, fmt.Errorf("grouping key '%s' does not start with a job", rest)
+	}
+	return labels, nil
+}
+
+// handlePushgateway ingests the samples of a body in the Prometheus text format as gauges. A push replaces the
+// values of the previous one, and counters, histograms and summaries hold totals, which summing them up as
+// statsd counters would add again at every push. The grouping labels are added as dimensions, overriding the
+// labels of the samples. As nothing is stored for a group, deleting it is accepted without effect.
+func (sd *StatsQ) handlePushgateway(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	grouping, err := ParseGroupingKey(r.URL.Path)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	data, ok := sd.readBody(w, r)
+	if !ok {
+		return
+	}
+	res := HTTPResult{}
+	for num := 1; len(data) > 0; num++ {
+		line := data
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			line, data = data[:idx], data[idx+1:]
+		} else {
+			data = nil
+		}
+		sp, err := parsePromLine(bytes.TrimSpace(line))
+		if err != nil {
+			sd.ParseErrors.Add(err)
+			res.Errors = append(res.Errors, newHTTPError(err, num, nil))
+			continue
+		}
+		if sp == nil {
+			continue
+		}
+		for k, v := range grouping {
+			sp.Dimensions.Add(k, v)
+		}
+		sd.Dispatch(sp)
+		res.Accepted++
+	}
+	writeHTTPResult(w, res)
+}
+
+// parsePromLine parses a sample of the Prometheus text format into a gauge. Comments, empty lines and samples
+// without a finite value (e.g. the quantiles of a summary without observations) return neither a packet nor
+// an error.
+func parsePromLine(line []byte) (*qtypes.StatsdPacket, error) {
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+	s := string(line)
+	end := strings.IndexAny(s, "{ \t")
+	if end < 1 {
+		return nil, newParseError(ParseErrMalformed, "expected 'name{labels} value'", line)
+	}
+	name, s := s[:end], s[end:]
+	dims := qtypes.NewDimensions()
+	if s[0] == '{' {
+		var err error
+		if s, err = parsePromLabels(s[1:], dims.Map); err != nil {
+			return nil, newParseError(ParseErrDimension, err.Error(), line)
+		}
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 1 && len(fields) != 2 {
+		return nil, newParseError(ParseErrMalformed, "expected 'name{labels} value [timestamp]'", line)
+	}
+	val, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, newParseError(ParseErrValue, fmt.Sprintf("invalid value '%s'", fields[0]), line)
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return nil, nil
+	}
+	return &qtypes.StatsdPacket{
+		Bucket:     sanitizeBucket(name),
+		ValFlt:     val,
+		Modifier:   "g",
+		Sampling:   1,
+		Dimensions: dims,
+	}, nil
+}
+
+// parsePromLabels parses 'name="value",...}' into labels and returns the remainder after the closing brace.
+func parsePromLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		idx := strings.IndexByte(s, '=')
+		if idx < 0 {
+			return s, fmt.Errorf("missing '=' in labels")
+		}
+		name := strings.TrimSpace(s[:idx])
+		s = strings.TrimLeft(s[idx+1:], " \t")
+		if name == "" || !strings.HasPrefix(s, "\"") {
+			return s, fmt.Errorf("expected label=\"value\"")
+		}
+		var val strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(s[i])
+				}
+				continue
+			}
+			val.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return s, fmt.Errorf("unterminated value of label '%s'", name)
+		}
+		labels[name] = val.String()
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return s, fmt.Errorf("expected ',' or '}' after label '%s'", name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package statsq
+
+import (
+	"errors"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseGroupingKey(t *testing.T) {
+	labels, err := ParseGroupingKey("/metrics/job/backup/instance/db1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "backup", "instance": "db1"}, labels)
+	// base64 encoded values, with and without padding
+	labels, err = ParseGroupingKey("/metrics/job@base64/YmFja3VwL2RhaWx5/path@base64/L3Zhci90bXA=/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "backup/daily", "path": "/var/tmp"}, labels)
+	labels, err = ParseGroupingKey("/metrics/job/backup/empty@base64/=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "backup", "empty": ""}, labels)
+
+	for _, path := range []string{"/metrics/job", "/metrics/job/backup/instance", "/metrics/instance/db1", "/metrics/job/", "/metrics/job/a/@base64/x", "/metrics/job@base64/%%%"} {
+		_, err = ParseGroupingKey(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestParsePromLine(t *testing.T) {
+	// comments, empty lines and samples without a finite value are skipped
+	for _, line := range []string{"# TYPE jobs_processed_total counter", "# HELP jobs_processed_total Jobs processed.", "", "latency{quantile=\"0.5\"} NaN", "jobs +Inf", "jobs -Inf 1495028544000"} {
+		sp, err := parsePromLine([]byte(line))
+		assert.Nil(t, sp, line)
+		assert.NoError(t, err, line)
+	}
+
+	sp, err := parsePromLine([]byte(`jobs_processed_total{queue="fast",note="say \"hi\"\n",path="C:\\tmp"} 42 1495028544000`))
+	assert.NoError(t, err)
+	assert.Equal(t, "jobs_processed_total", sp.Bucket)
+	assert.Equal(t, "g", sp.Modifier)
+	assert.Equal(t, float64(42), sp.ValFlt)
+	assert.Equal(t, map[string]string{"queue": "fast", "note": "say \"hi\"\n", "path": `C:\tmp`}, sp.Dimensions.Map)
+
+	// totals of counters, histograms and summaries are gauges as well
+	for _, name := range []string{"duration_seconds_bucket{le=\"+Inf\"}", "duration_seconds_sum", "latency_count", "latency{quantile=\"0.99\"}"} {
+		sp, err := parsePromLine([]byte(name + " 1.5"))
+		assert.NoError(t, err, name)
+		assert.Equal(t, "g", sp.Modifier, name)
+		assert.Equal(t, 1.5, sp.ValFlt, name)
+	}
+
+	cases := map[string]error{
+		"{job=\"a\"} 1":               ErrMalformedLine,
+		"jobs":                        ErrMalformedLine,
+		"jobs 1 2 3":                  ErrMalformedLine,
+		"jobs x":                      ErrBadValue,
+		"jobs{queue} 1":               ErrBadDimension,
+		"jobs{queue=fast} 1":          ErrBadDimension,
+		"jobs{queue=\"fast} 1":        ErrBadDimension,
+		"jobs{queue=\"a\" x=\"b\"} 1": ErrBadDimension,
+	}
+	for line, exp := range cases {
+		sp, err := parsePromLine([]byte(line))
+		assert.Nil(t, sp, line)
+		assert.True(t, errors.Is(err, exp), "%q: expected %v, got %v", line, exp.(*ParseError).Class, err)
+	}
+}
+
+func TestStatsQ_Pushgateway(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log"}))
+	body := `# TYPE jobs_processed_total counter
+jobs_processed_total{queue="fast",job="spoofed"} 42
+# TYPE last_success_timestamp_seconds gauge
+last_success_timestamp_seconds 1495028544
+`
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		req := httptest.NewRequest(method, "/metrics/job/backup/instance/db1", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		sd.HTTPHandler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		pkts := drainPackets(&sd)
+		assert.Len(t, pkts, 2)
+		assert.Equal(t, "jobs_processed_total", pkts[0].Bucket)
+		assert.Equal(t, "g", pkts[0].Modifier)
+		assert.Equal(t, map[string]string{"job": "backup", "instance": "db1", "queue": "fast"}, pkts[0].Dimensions.Map)
+		assert.Equal(t, "g", pkts[1].Modifier)
+		assert.Equal(t, float64(1495028544), pkts[1].ValFlt)
+		assert.Equal(t, map[string]string{"job": "backup", "instance": "db1"}, pkts[1].Dimensions.Map)
+	}
+
+	code, res := postHTTP(&sd, "/metrics/job/backup", "jobs 1\njobs x\n", false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 1, res.Accepted)
+	assert.Equal(t, []HTTPError{{Line: 2, Class: ParseErrValue, Error: `invalid value 'x' in line "jobs x"`}}, res.Errors)
+	drainPackets(&sd)
+
+	// a push replaces the totals of the previous one, samples without observations are skipped
+	for _, body := range []string{"jobs_processed_total 100\n", "jobs_processed_total 150\nlatency{quantile=\"0.5\"} NaN\n"} {
+		code, res = postHTTP(&sd, "/metrics/job/backup", body, false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, res.Errors)
+		for _, sp := range drainPackets(&sd) {
+			sd.HandlerStatsdPacket(sp)
+		}
+	}
+	bid := NewBucketID("jobs_processed_total", qtypes.NewDimensionsPre(map[string]string{"job": "backup"}))
+	assert.Equal(t, float64(150), sd.Gauges[bid.ID])
+	assert.Len(t, sd.Gauges, 1)
+
+	code, res = postHTTP(&sd, "/metrics/job/backup/instance", "jobs 1\n", false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "request", res.Errors[0].Class)
+
+	rec := httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/metrics/job/backup", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	rec = httptest.NewRecorder()
+	sd.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/job/backup", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Len(t, drainPackets(&sd), 0)
+}
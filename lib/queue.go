@@ -0,0 +1,87 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"sync/atomic"
+)
+
+// Policies applied if a packet queue is full.
+const (
+	// OverflowBlock waits until the queue has room, stalling the reader (and the kernel drops datagrams)
+	OverflowBlock = "block"
+	// OverflowDropNewest drops the packet that does not fit
+	OverflowDropNewest = "drop-newest"
+	// OverflowDropOldest drops the oldest queued packet to make room
+	OverflowDropOldest = "drop-oldest"
+)
+
+// IsOverflowPolicy returns true if policy is known.
+func IsOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+		return true
+	}
+	return false
+}
+
+// PacketQueue is a bounded queue of packets, keeping track of dropped packets and its high-water mark.
+type PacketQueue struct {
+	C         chan *qtypes.StatsdPacket
+	Policy    string
+	dropped   uint64
+	highWater int64
+}
+
+func NewPacketQueue(size int, policy string) *PacketQueue {
+	if size < 1 {
+		size = MAX_UNPROCESSED_PACKETS
+	}
+	return &PacketQueue{
+		C:      make(chan *qtypes.StatsdPacket, size),
+		Policy: policy,
+	}
+}
+
+// Push queues the packet according to the overflow policy.
+func (q *PacketQueue) Push(sp *qtypes.StatsdPacket) {
+	switch q.Policy {
+	case OverflowDropNewest:
+		select {
+		case q.C <- sp:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for pushed := false; !pushed; {
+			select {
+			case q.C <- sp:
+				pushed = true
+			default:
+				select {
+				case <-q.C:
+					atomic.AddUint64(&q.dropped, 1)
+				default:
+				}
+			}
+		}
+	default:
+		q.C <- sp
+	}
+	l := int64(len(q.C))
+	for {
+		hw := atomic.LoadInt64(&q.highWater)
+		if l <= hw || atomic.CompareAndSwapInt64(&q.highWater, hw, l) {
+			return
+		}
+	}
+}
+
+// Cap returns the size of the queue.
+func (q *PacketQueue) Cap() int {
+	return cap(q.C)
+}
+
+// Stats returns the packets dropped and the high-water mark since the last call.
+func (q *PacketQueue) Stats() (dropped uint64, highWater int64) {
+	return atomic.SwapUint64(&q.dropped, 0), atomic.SwapInt64(&q.highWater, int64(len(q.C)))
+}
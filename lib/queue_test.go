@@ -0,0 +1,77 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func queuePackets(n int) []*qtypes.StatsdPacket {
+	res := make([]*qtypes.StatsdPacket, n)
+	for i := range res {
+		res[i] = &qtypes.StatsdPacket{Bucket: "gorets", ValFlt: float64(i), Modifier: "c", Sampling: 1}
+	}
+	return res
+}
+
+func TestPacketQueue_DropNewest(t *testing.T) {
+	q := NewPacketQueue(3, OverflowDropNewest)
+	for _, sp := range queuePackets(5) {
+		q.Push(sp)
+	}
+	dropped, hw := q.Stats()
+	assert.Equal(t, uint64(2), dropped)
+	assert.Equal(t, int64(3), hw)
+	assert.Equal(t, float64(0), (<-q.C).ValFlt)
+	dropped, hw = q.Stats()
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, int64(3), hw, "the high-water mark starts at the length of the last call")
+	_, hw = q.Stats()
+	assert.Equal(t, int64(2), hw)
+}
+
+func TestPacketQueue_DropOldest(t *testing.T) {
+	q := NewPacketQueue(3, OverflowDropOldest)
+	for _, sp := range queuePackets(5) {
+		q.Push(sp)
+	}
+	dropped, _ := q.Stats()
+	assert.Equal(t, uint64(2), dropped)
+	for _, exp := range []float64{2, 3, 4} {
+		assert.Equal(t, exp, (<-q.C).ValFlt)
+	}
+}
+
+func TestPacketQueue_Block(t *testing.T) {
+	q := NewPacketQueue(1, OverflowBlock)
+	pkts := queuePackets(2)
+	q.Push(pkts[0])
+	done := make(chan bool)
+	go func() {
+		q.Push(pkts[1])
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("push should block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-q.C
+	select {
+	case <-done:
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("push still blocked")
+	}
+	dropped, _ := q.Stats()
+	assert.Equal(t, uint64(0), dropped)
+}
+
+func TestNewStatsQQueue(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"queue-size": "10", "queue-overflow": "drop-oldest"}))
+	assert.Equal(t, 10, cap(sd.In))
+	assert.Equal(t, OverflowDropOldest, sd.OverflowPolicy)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"queue-size": "0", "queue-overflow": "spill"}))
+	assert.Equal(t, MAX_UNPROCESSED_PACKETS, sd.QueueSize)
+	assert.Equal(t, OverflowBlock, sd.OverflowPolicy)
+}
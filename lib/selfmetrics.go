@@ -0,0 +1,89 @@
+package statsq
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PROC_NET_UDP lists the UDP sockets of the host, including the datagrams dropped because the receive buffer was full.
+var PROC_NET_UDP = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// ReadUDPDrops sums up the drops of the sockets bound to port, as listed in a /proc/net/udp file.
+func ReadUDPDrops(path string, port int) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var drops uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		//  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[0] == "sl" {
+			continue
+		}
+		idx := strings.LastIndexByte(fields[1], ':')
+		p, err := strconv.ParseInt(fields[1][idx+1:], 16, 32)
+		if err != nil || int(p) != port {
+			continue
+		}
+		d, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return drops, fmt.Errorf("invalid drops '%s' in %s", fields[len(fields)-1], path)
+		}
+		drops += d
+	}
+	return drops, scanner.Err()
+}
+
+// udpOverruns returns the datagrams the kernel dropped for the UDP listener since the last call.
+func (sd *StatsQ) udpOverruns() (uint64, bool) {
+	port := atomic.LoadInt64(&sd.udpPort)
+	if port == 0 {
+		return 0, false
+	}
+	var total uint64
+	for _, path := range PROC_NET_UDP {
+		drops, err := ReadUDPDrops(path, int(port))
+		if err != nil && !os.IsNotExist(err) {
+			sd.Log("debug", err.Error())
+		}
+		total += drops
+	}
+	prev := sd.udpDrops
+	sd.udpDrops = total
+	if total < prev {
+		return 0, true
+	}
+	return total - prev, true
+}
+
+// FanOutSelfMetrics sends the packets dropped and the high-water mark of the queue of each shard,
+// the parse errors per class as well as the UDP receive buffer overruns, prefixed with self-metrics.
+func (sd *StatsQ) FanOutSelfMetrics(w *Window, now time.Time) int64 {
+	var num int64
+	for _, s := range sd.Shards {
+		dims := map[string]string{"shard": strconv.Itoa(s.ID)}
+		dropped, highWater := s.Queue.Stats()
+		sd.sendMetric(w, qtypes.NewExt(sd.Name, sd.SelfMetrics+".queue.dropped", qtypes.Counter, float64(dropped), dims, now, false))
+		sd.sendMetric(w, qtypes.NewExt(sd.Name, sd.SelfMetrics+".queue.high_water", qtypes.Gauge, float64(highWater), dims, now, false))
+		sd.sendMetric(w, qtypes.NewExt(sd.Name, sd.SelfMetrics+".queue.size", qtypes.Gauge, float64(s.Queue.Cap()), dims, now, false))
+		num += 3
+	}
+	for class, cnt := range sd.ParseErrors.Stats() {
+		sd.sendMetric(w, qtypes.NewExt(sd.Name, sd.SelfMetrics+".parse_errors", qtypes.Counter, float64(cnt), map[string]string{"class": class}, now, false))
+		num++
+	}
+	if overruns, ok := sd.udpOverruns(); ok {
+		sd.sendMetric(w, qtypes.NewExt(sd.Name, sd.SelfMetrics+".udp.overruns", qtypes.Counter, float64(overruns), map[string]string{}, now, false))
+		num++
+	}
+	return num
+}
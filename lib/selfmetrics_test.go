@@ -0,0 +1,81 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 20817 2 0000000000000000 12
+  124: 0100007F:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 20818 2 0000000000000000 3
+  125: 00000000:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 15132 2 0000000000000000 7
+`
+
+func TestReadUDPDrops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsq")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "udp")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(procNetUDP), 0644))
+	drops, err := ReadUDPDrops(path, 8125)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(15), drops)
+	drops, err = ReadUDPDrops(path, 8126)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), drops)
+	_, err = ReadUDPDrops(filepath.Join(dir, "missing"), 8125)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStatsQFanOutSelfMetrics(t *testing.T) {
+	pre := map[string]string{
+		"self-metrics":   "statsq",
+		"queue-size":     "2",
+		"queue-overflow": "drop-newest",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	// the shard is not started, so that its queue fills up
+	s := sd.newShard(0, []*Window{sd.Window.clone()}, map[string]BucketID{}, map[string]BucketOptions{}, map[string]*TopKRule{})
+	sd.Shards = []*Shard{s}
+	for _, sp := range queuePackets(5) {
+		sd.HandlerStatsdPacket(sp)
+	}
+	sd.ParseLine("gorets:x|c")
+	sd.ParseLine("gorets:1|c host")
+	sd.ParseLine("gorets:2|c host")
+	num := sd.FanOutSelfMetrics(sd.Window, time.Unix(1495028544, 0))
+	assert.Equal(t, int64(3+len(ParseErrorClasses)), num)
+	got := map[string]float64{}
+	for i := int64(0); i < num; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			if met.Name == "statsq.parse_errors" {
+				got[met.Name+"."+met.Dimensions["class"]] = met.Value
+				continue
+			}
+			assert.Equal(t, "0", met.Dimensions["shard"])
+			got[met.Name] = met.Value
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"statsq.queue.dropped":            3,
+		"statsq.queue.high_water":         2,
+		"statsq.queue.size":               2,
+		"statsq.parse_errors.malformed":   0,
+		"statsq.parse_errors.type":        0,
+		"statsq.parse_errors.value":       1,
+		"statsq.parse_errors.sample_rate": 0,
+		"statsq.parse_errors.dimension":   2,
+	}, got)
+}
@@ -0,0 +1,243 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"log"
+)
+
+const (
+	// FNV-1a, used to assign series to shards
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Shard aggregates the packets of the series assigned to it. With shards configured each shard runs
+// in its own goroutine and hands its windows to the merger at every flush; otherwise StatsQ
+// aggregates into its own windows through a single shard.
+type Shard struct {
+	sd            *StatsQ
+	ID            int
+	Queue         *PacketQueue
+	Windows       []*Window
+	BucketMapping map[string]BucketID
+	BucketOpts    map[string]BucketOptions
+	topKCache     map[string]*TopKRule
+	// created holds the buckets added since the last snapshot, if the shard is merged
+	created   map[string]BucketID
+	snapshots chan snapshotRequest
+}
+
+// ShardSnapshot is the state a shard hands to the merger for a window.
+type ShardSnapshot struct {
+	Window  *Window
+	Buckets map[string]BucketID
+}
+
+type snapshotRequest struct {
+	window int
+	// forget lists the buckets the merger dropped
+	forget []string
+	reply  chan ShardSnapshot
+}
+
+func (sd *StatsQ) newShard(id int, windows []*Window, mapping map[string]BucketID, opts map[string]BucketOptions, cache map[string]*TopKRule) *Shard {
+	return &Shard{
+		sd:            sd,
+		ID:            id,
+		Queue:         NewPacketQueue(sd.QueueSize, sd.OverflowPolicy),
+		Windows:       windows,
+		BucketMapping: mapping,
+		BucketOpts:    opts,
+		topKCache:     cache,
+		snapshots:     make(chan snapshotRequest),
+	}
+}
+
+// localShard returns the shard aggregating into the windows of StatsQ, used if no shards are configured.
+func (sd *StatsQ) localShard() *Shard {
+	if sd.shard == nil {
+		sd.shard = sd.newShard(0, sd.Windows, sd.BucketMapping, sd.BucketOpts, sd.topKCache)
+	}
+	return sd.shard
+}
+
+// ShardCount returns the number of shards configured, at least one.
+func (sd *StatsQ) ShardCount() int {
+	n := sd.IntOr("shards", 1)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// StartShards creates n shards with their own windows and starts their goroutines.
+func (sd *StatsQ) StartShards(n int) {
+	sd.Shards = make([]*Shard, n)
+	for i := range sd.Shards {
+		windows := make([]*Window, len(sd.Windows))
+		for j, w := range sd.Windows {
+			windows[j] = w.clone()
+		}
+		s := sd.newShard(i, windows, map[string]BucketID{}, map[string]BucketOptions{}, map[string]*TopKRule{})
+		s.created = map[string]BucketID{}
+		sd.Shards[i] = s
+		go s.Loop()
+	}
+	sd.Log("info", fmt.Sprintf("Started %d aggregation shards", n))
+}
+
+// Dispatch hands the packet to the shard owning its series, or to the In channel if there are no shards.
+func (sd *StatsQ) Dispatch(sp *qtypes.StatsdPacket) {
+	if len(sd.Shards) == 0 {
+		sd.In <- sp
+		return
+	}
+	sd.ShardFor(sp).Queue.Push(sp)
+}
+
+// ShardFor returns the shard owning the series of the packet. The hash does not depend on the order
+// of the dimensions, so that equal series end up in the same shard without sorting.
+func (sd *StatsQ) ShardFor(sp *qtypes.StatsdPacket) *Shard {
+	h := fnvString(fnvOffset64, sp.Bucket)
+	var dh uint64
+	for k, v := range sp.Dimensions.Map {
+		dh += fnvString(fnvString(fnvString(fnvOffset64, k), "="), v)
+	}
+	h ^= dh
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return sd.Shards[h%uint64(len(sd.Shards))]
+}
+
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// Loop aggregates incoming packets until asked for a snapshot, which includes all packets queued so far.
+// It returns after the final flush on shutdown.
+func (s *Shard) Loop() {
+	for {
+		select {
+		case sp := <-s.Queue.C:
+			s.Handle(sp)
+		case req := <-s.snapshots:
+			for n := len(s.Queue.C); n > 0; n-- {
+				s.Handle(<-s.Queue.C)
+			}
+			s.forget(req.forget)
+			req.reply <- s.Snapshot(req.window)
+		case <-s.sd.life.done:
+			return
+		}
+	}
+}
+
+// Snapshot hands over the interval of a window and the buckets created since the last snapshot.
+func (s *Shard) Snapshot(window int) ShardSnapshot {
+	snap := ShardSnapshot{
+		Window:  s.Windows[window].Snapshot(s.BucketOpts),
+		Buckets: s.created,
+	}
+	s.created = map[string]BucketID{}
+	return snap
+}
+
+// forget drops the buckets the merger dropped, so that they are announced again with their next update. Buckets
+// updated in the meantime are announced with the snapshot right away. The values of gauges are kept.
+func (s *Shard) forget(ids []string) {
+	for _, id := range ids {
+		bid, ok := s.BucketMapping[id]
+		if !ok {
+			continue
+		}
+		updated := false
+		for _, w := range s.Windows {
+			updated = updated || w.updated(id)
+		}
+		if updated {
+			s.created[id] = bid
+			continue
+		}
+		delete(s.BucketMapping, id)
+		delete(s.BucketOpts, id)
+	}
+}
+
+// MergeShards collects the snapshots of all shards for the window and merges them into it.
+// The shards take their snapshots in parallel.
+func (sd *StatsQ) MergeShards(w *Window) {
+	idx := -1
+	for i := range sd.Windows {
+		if sd.Windows[i] == w {
+			idx = i
+		}
+	}
+	if idx < 0 || len(sd.Shards) == 0 {
+		return
+	}
+	reply := make(chan ShardSnapshot, len(sd.Shards))
+	forget := sd.forgotten
+	sd.forgotten = nil
+	for _, s := range sd.Shards {
+		s.snapshots <- snapshotRequest{idx, forget, reply}
+	}
+	for range sd.Shards {
+		snap := <-reply
+		for id, bid := range snap.Buckets {
+			sd.BucketMapping[id] = bid
+			sd.BucketOpts[id] = sd.OptionsFor(bid.BucketName)
+		}
+		w.Merge(snap.Window)
+	}
+}
+
+// Handle aggregates a packet into the windows of the shard.
+func (s *Shard) Handle(sp *qtypes.StatsdPacket) {
+	sd := s.sd
+	if sd.ReceiveCounter != "" {
+		for _, w := range s.Windows {
+			v, ok := w.Counters[sd.ReceiveCounter]
+			if !ok || v < 0 {
+				w.Counters[sd.ReceiveCounter] = 0
+			}
+			w.Counters[sd.ReceiveCounter] += 1
+		}
+	}
+	dims := sd.GlobalDims.Merge(sp.Dimensions)
+	if !sd.IngestFilter.Pass(sp.Bucket, PacketType(sp.Modifier), dims.Map) {
+		return
+	}
+	if sp.Modifier == "c" {
+		if rule := topKRuleFor(sd.TopKRules, s.topKCache, sp.Bucket); rule != nil {
+			if _, ok := dims.Map[rule.Dimension]; ok {
+				s.handleTopK(rule, sp, dims)
+				return
+			}
+		}
+	}
+	bid := NewBucketID(sp.Bucket, dims)
+	bkey := bid.ID
+	s.addBucket(bid)
+	opts := s.BucketOpts[bkey]
+	for _, w := range s.Windows {
+		w.Handle(bkey, opts, sp)
+	}
+}
+
+func (s *Shard) addBucket(bid BucketID) {
+	if _, ok := s.BucketMapping[bid.ID]; ok {
+		return
+	}
+	log.Printf("Include bid '%s' w/ key '%s' in BucketMapping", bid.BucketName, bid.ID)
+	s.BucketMapping[bid.ID] = bid
+	s.BucketOpts[bid.ID] = s.sd.OptionsFor(bid.BucketName)
+	if s.created != nil {
+		s.created[bid.ID] = bid
+	}
+}
@@ -0,0 +1,214 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func shardLines() []string {
+	lines := []string{}
+	for i := 0; i < 50; i++ {
+		host := fmt.Sprintf("host%d", i%10)
+		lines = append(lines,
+			fmt.Sprintf("api.requests:%d|c host=%s,service=http", i, host),
+			fmt.Sprintf("api.latency:%d|ms host=%s", i*10, host),
+			fmt.Sprintf("queue.depth:%d|g host=%s", i, host),
+			fmt.Sprintf("users:user%d|s host=%s", i%7, host),
+			fmt.Sprintf("hits:1|c customer=c%d,service=http", i%5),
+		)
+	}
+	return lines
+}
+
+func TestStatsQShardFor(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{}))
+	sd.StartShards(4)
+	a := &qtypes.StatsdPacket{Bucket: "api", Dimensions: qtypes.NewDimensionsPre(map[string]string{"a": "1", "b": "2", "c": "3"})}
+	b := &qtypes.StatsdPacket{Bucket: "api", Dimensions: qtypes.NewDimensionsPre(map[string]string{"c": "3", "b": "2", "a": "1"})}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, sd.ShardFor(a), sd.ShardFor(b))
+	}
+	used := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		p := &qtypes.StatsdPacket{Bucket: "api", Dimensions: qtypes.NewDimensionsPre(map[string]string{"host": fmt.Sprintf("h%d", i)})}
+		used[sd.ShardFor(p).ID]++
+	}
+	assert.Len(t, used, 4)
+	for id, n := range used {
+		assert.True(t, n > 150, "shard %d got %d of 1000 series", id, n)
+	}
+}
+
+func TestStatsQShards(t *testing.T) {
+	pre := map[string]string{
+		"set-hll":                  "^users$",
+		"topk":                     "customers",
+		"topk.customers.bucket":    "^hits$",
+		"topk.customers.dimension": "customer",
+		"topk.customers.k":         "3",
+		"receive-counter":          "received",
+	}
+	single := NewStatsQ(NewPreCfg(pre))
+	sharded := NewStatsQ(NewPreCfg(pre))
+	sharded.StartShards(4)
+	for _, line := range shardLines() {
+		single.ParseLine(line)
+		sharded.ParseLine(line)
+	}
+	for round := 0; round < 2; round++ {
+		sharded.MergeShards(sharded.Window)
+		assert.Equal(t, single.Counters, sharded.Counters)
+		assert.Equal(t, single.Gauges, sharded.Gauges)
+		assert.Equal(t, single.GaugeInactivity, sharded.GaugeInactivity)
+		assert.Equal(t, len(single.BucketMapping), len(sharded.BucketMapping))
+		assert.Len(t, sharded.Timers, len(single.Timers))
+		for id, timer := range single.Timers {
+			got := sharded.Timers[id]
+			sort.Float64s(got)
+			sort.Float64s(timer)
+			assert.Equal(t, timer, got)
+		}
+		assert.Len(t, sharded.HLLSets, len(single.HLLSets))
+		for id, hll := range single.HLLSets {
+			assert.Equal(t, hll.Count(), sharded.HLLSets[id].Count())
+		}
+		assert.Len(t, sharded.TopK, len(single.TopK))
+		for id, tk := range single.TopK {
+			assert.Equal(t, tk.Top(3), sharded.TopK[id].Top(3))
+		}
+		// the shards only hand over the gauges written since the last merge
+		single.Reset()
+		sharded.Reset()
+		single.ParseLine("queue.depth:100|g host=host1")
+		sharded.ParseLine("queue.depth:100|g host=host1")
+	}
+}
+
+func TestWindow_SnapshotMerge(t *testing.T) {
+	w := NewWindow("10s", 10*time.Second, nil)
+	opts := BucketOptions{}
+	w.Handle("c", opts, &qtypes.StatsdPacket{ValFlt: 2, Modifier: "c", Sampling: 1})
+	w.Handle("g", opts, &qtypes.StatsdPacket{ValFlt: 5, Modifier: "g"})
+	w.Handle("t", opts, &qtypes.StatsdPacket{ValFlt: 1, Modifier: "ms"})
+	snap := w.Snapshot(nil)
+	assert.Len(t, w.Counters, 0)
+	assert.Len(t, w.Timers, 0)
+	assert.Equal(t, float64(5), w.Gauges["g"])
+	assert.Equal(t, 1, w.GaugeInactivity["g"])
+	assert.Equal(t, map[string]float64{"g": 5}, snap.Gauges)
+	// gauges are only part of the snapshot after an update
+	assert.Len(t, w.Snapshot(nil).Gauges, 0)
+	w.Handle("g", opts, &qtypes.StatsdPacket{ValFlt: 1, ValStr: "+", Modifier: "g"})
+	assert.Equal(t, map[string]float64{"g": 6}, w.Snapshot(map[string]BucketOptions{"g": {GaugeDelete: true}}).Gauges)
+	assert.Len(t, w.Gauges, 0)
+
+	m := NewWindow("10s", 10*time.Second, nil)
+	m.Counters["c"] = 1
+	m.Timers["t"] = Float64Slice{2}
+	m.Merge(snap)
+	assert.Equal(t, float64(3), m.Counters["c"])
+	assert.Equal(t, Float64Slice{2, 1}, m.Timers["t"])
+	assert.Equal(t, float64(5), m.Gauges["g"])
+	assert.Equal(t, 0, m.GaugeInactivity["g"])
+}
+
+func BenchmarkShards(b *testing.B) {
+	pkts := []*qtypes.StatsdPacket{}
+	parser := MsgParser{}
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("api.latency:%d|ms host=h%d,service=s%d", i, i%100, i%10)
+		if i%2 == 0 {
+			line = fmt.Sprintf("api.requests:%d|c host=h%d,service=s%d", i, i%100, i%10)
+		}
+		sp, _ := parser.parseLine([]byte(line))
+		pkts = append(pkts, sp)
+	}
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			sd := NewStatsQ(NewPreCfg(map[string]string{"backends": "log"}))
+			sd.StartShards(n)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					sd.HandlerStatsdPacket(pkts[i%len(pkts)])
+					i++
+				}
+			})
+			// wait for the shards to aggregate all packets
+			sd.MergeShards(sd.Window)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
+
+// blockingBackend blocks in Flush until released, counting the values sent.
+type blockingBackend struct {
+	mu       sync.Mutex
+	total    float64
+	flushing chan bool
+	release  chan bool
+}
+
+func (bb *blockingBackend) Name() string { return "blocking" }
+
+func (bb *blockingBackend) Send(m qtypes.Metric) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if m.Name == "gorets" {
+		bb.total += m.Value
+	}
+}
+
+func (bb *blockingBackend) Flush() error {
+	select {
+	case bb.flushing <- true:
+	default:
+	}
+	<-bb.release
+	return nil
+}
+
+func (bb *blockingBackend) Total() float64 {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	return bb.total
+}
+
+func TestStatsQLoopChannelFlushInBackground(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"intervals": "100ms", "shards": "2"}))
+	bb := &blockingBackend{flushing: make(chan bool), release: make(chan bool)}
+	sd.Window.Routes = []Route{NewRoute(bb, FilterList{})}
+	go sd.LoopChannel()
+	select {
+	case <-bb.flushing:
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("flush timeout")
+	}
+	// the backend is stuck, still the shards take more packets than their queues hold
+	n := 3 * MAX_UNPROCESSED_PACKETS
+	done := make(chan bool)
+	go func() {
+		sp := &qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 1, Modifier: "c", Sampling: 1}
+		for i := 0; i < n; i++ {
+			sd.HandlerStatsdPacket(sp)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ingest blocked by the flush")
+	}
+	close(bb.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for bb.Total() < float64(n) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, float64(n), bb.Total())
+}
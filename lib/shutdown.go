@@ -0,0 +1,247 @@
+package statsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+)
+
+var (
+	// ErrStarted is returned by Start if StatsQ was started before.
+	ErrStarted = errors.New("statsq is already started")
+	// ErrStopped is returned once StatsQ is shutting down.
+	ErrStopped = errors.New("statsq is stopped")
+)
+
+// lifecycle keeps track of what has to be stopped on shutdown: the listeners and connections packets are read
+// from, the goroutines dispatching them and the loop flushing the windows.
+type lifecycle struct {
+	mu       sync.Mutex
+	started  bool
+	stopping bool
+	looping  bool
+	closers  map[io.Closer]struct{}
+	// addrs holds the addresses bound, by the config key of the listener
+	addrs map[string]net.Addr
+	// producers counts the goroutines that dispatch packets
+	producers sync.WaitGroup
+	// closing is closed as the shutdown starts, stop once no more packets are dispatched and done after
+	// the final flush
+	closing  chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	flushErr error
+}
+
+// shutdowner is closed gracefully, like *http.Server.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		closers: map[io.Closer]struct{}{},
+		addrs:   map[string]net.Addr{},
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// track registers c to be closed on shutdown. If the shutdown already started, c is closed right away.
+func (l *lifecycle) track(c io.Closer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		c.Close()
+		return false
+	}
+	l.closers[c] = struct{}{}
+	return true
+}
+
+func (l *lifecycle) untrack(c io.Closer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.closers, c)
+}
+
+func (l *lifecycle) bind(key string, addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addrs[key] = addr
+}
+
+// start returns an error if StatsQ was started or stopped before.
+func (l *lifecycle) start() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return ErrStopped
+	}
+	if l.started {
+		return ErrStarted
+	}
+	l.started = true
+	return nil
+}
+
+// enter registers a goroutine dispatching packets, unless the shutdown already started.
+func (l *lifecycle) enter() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.producers.Add(1)
+	return true
+}
+
+func (l *lifecycle) exit() {
+	l.producers.Done()
+}
+
+// startLoop registers LoopChannel, which does the final flush then.
+func (l *lifecycle) startLoop() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping || l.looping {
+		return false
+	}
+	l.looping = true
+	return true
+}
+
+// beginStop refuses new listeners and producers, returning what has to be closed and whether LoopChannel runs.
+func (l *lifecycle) beginStop() (closers []io.Closer, looping bool, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return nil, false, false
+	}
+	l.stopping = true
+	close(l.closing)
+	for c := range l.closers {
+		closers = append(closers, c)
+	}
+	l.closers = nil
+	return closers, l.looping, true
+}
+
+// ShutdownTimeout returns how long Shutdown waits for the listeners and the final flush.
+func (sd *StatsQ) ShutdownTimeout() time.Duration {
+	timeout, err := sd.shutdownTimeout()
+	if err != nil {
+		sd.Log("warn", fmt.Sprintf("%s, fall back to %s", err.Error(), DEFAULT_SHUTDOWN_TIMEOUT))
+		return DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	return timeout
+}
+
+func (sd *StatsQ) shutdownTimeout() (time.Duration, error) {
+	s := sd.StringOr("shutdown-timeout", "")
+	if s == "" {
+		return DEFAULT_SHUTDOWN_TIMEOUT, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("shutdown-timeout '%s' is not a positive duration", s)
+	}
+	return timeout, nil
+}
+
+// Shutdown closes the listeners, aggregates the packets received until then and flushes all windows a last time.
+// It fails if that does not finish within shutdown-timeout, e.g. because a backend hangs, or if a backend fails.
+func (sd *StatsQ) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sd.ShutdownTimeout())
+	defer cancel()
+	return sd.shutdown(ctx)
+}
+
+func (sd *StatsQ) shutdown(ctx context.Context) error {
+	closers, looping, ok := sd.life.beginStop()
+	if !ok {
+		return ErrStopped
+	}
+	for _, c := range closers {
+		var err error
+		if s, ok := c.(shutdowner); ok {
+			err = s.Shutdown(ctx)
+		} else {
+			err = c.Close()
+		}
+		if err != nil {
+			sd.Log("debug", fmt.Sprintf("closing listener: %s", err.Error()))
+		}
+	}
+	if err := waitFor(ctx, sd.life.producers.Wait); err != nil {
+		return fmt.Errorf("waiting for the listeners: %w", err)
+	}
+	close(sd.life.stop)
+	if !looping {
+		go sd.finalFlush()
+	}
+	select {
+	case <-sd.life.done:
+	case <-ctx.Done():
+		// the webhook goroutine still exits once it sent what is queued
+		sd.Notifier.close(ctx)
+		return fmt.Errorf("final flush: %w", ctx.Err())
+	}
+	if err := sd.Notifier.close(ctx); err != nil {
+		return fmt.Errorf("sending alert notifications: %w", err)
+	}
+	if sd.life.flushErr != nil {
+		return fmt.Errorf("final flush: %w", sd.life.flushErr)
+	}
+	sd.Log("info", "Shutdown complete")
+	return nil
+}
+
+// finalFlush aggregates the packets still queued and flushes all windows, stopping the shards afterwards.
+func (sd *StatsQ) finalFlush() {
+	sd.drainIn()
+	now := time.Now()
+	errs := []error{}
+	for _, w := range sd.Windows {
+		sd.MergeShards(w)
+		errs = append(errs, sd.FlushLastInterval(w, now))
+	}
+	sd.life.flushErr = errors.Join(errs...)
+	close(sd.life.done)
+}
+
+// drainIn aggregates the packets left in the In channel.
+func (sd *StatsQ) drainIn() {
+	for {
+		select {
+		case sp := <-sd.In:
+			sd.HandlerStatsdPacket(sp)
+		default:
+			return
+		}
+	}
+}
+
+// waitFor runs wait, returning early if ctx is done.
+func waitFor(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
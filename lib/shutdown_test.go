@@ -0,0 +1,163 @@
+package statsq
+
+import (
+	"context"
+	"errors"
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingBackend sums up the values sent per metric, keeps the time of the last one and fails to flush with err.
+type recordingBackend struct {
+	mu    sync.Mutex
+	sums  map[string]float64
+	times map[string]time.Time
+	err   error
+}
+
+func (rb *recordingBackend) Name() string { return "recording" }
+
+func (rb *recordingBackend) Send(m qtypes.Metric) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.sums[m.Name] += m.Value
+	if rb.times == nil {
+		rb.times = map[string]time.Time{}
+	}
+	rb.times[m.Name] = m.Time
+}
+
+func (rb *recordingBackend) Time(name string) time.Time {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.times[name]
+}
+
+func (rb *recordingBackend) Flush() error {
+	return rb.err
+}
+
+func (rb *recordingBackend) Sum(name string) float64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.sums[name]
+}
+
+func TestStatsQ_ShutdownFlushes(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"intervals": "1h", "shards": "2"}))
+	rb := &recordingBackend{sums: map[string]float64{}}
+	sd.Window.Routes = []Route{NewRoute(rb, FilterList{})}
+	sd.StartShards(sd.ShardCount())
+	looping := make(chan bool)
+	go func() {
+		sd.LoopChannel()
+		close(looping)
+	}()
+	for i := 0; i < 10; i++ {
+		sd.Dispatch(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 1, Modifier: "c", Sampling: 1, Dimensions: qtypes.NewDimensions()})
+	}
+	sd.In <- &qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 5, Modifier: "c", Sampling: 1, Dimensions: qtypes.NewDimensions()}
+	assert.NoError(t, sd.Shutdown())
+	assert.Equal(t, float64(15), rb.Sum("gorets"))
+	select {
+	case <-looping:
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("LoopChannel did not return")
+	}
+	assert.Equal(t, ErrStopped, sd.Shutdown())
+}
+
+func TestStatsQ_ShutdownStampsLastInterval(t *testing.T) {
+	pre := map[string]string{
+		"intervals":        "1h",
+		"align-flushes":    "true",
+		"flush-timestamp":  "start",
+		"partial-interval": "discard",
+		"backends":         "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	rb := &recordingBackend{sums: map[string]float64{}}
+	sd.Window.Routes = []Route{NewRoute(rb, FilterList{})}
+	start := time.Now()
+	go sd.LoopChannel()
+	sd.Dispatch(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 1, Modifier: "c", Sampling: 1, Dimensions: qtypes.NewDimensions()})
+	assert.NoError(t, sd.Shutdown())
+	// the last interval is partial, but not discarded, and stamped with the start of the hour
+	assert.Equal(t, float64(1), rb.Sum("gorets"))
+	assert.Equal(t, start.Truncate(time.Hour).Unix(), rb.Time("gorets").Unix())
+}
+
+func TestStatsQ_ShutdownWithoutLoop(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{}))
+	rb := &recordingBackend{sums: map[string]float64{}, err: errors.New("connection refused")}
+	sd.Window.Routes = []Route{NewRoute(rb, FilterList{})}
+	sd.Dispatch(&qtypes.StatsdPacket{Bucket: "gorets", ValFlt: 2, Modifier: "c", Sampling: 1, Dimensions: qtypes.NewDimensions()})
+	err := sd.Shutdown()
+	assert.EqualError(t, err, "final flush: backend 'recording': connection refused")
+	assert.Equal(t, float64(2), rb.Sum("gorets"))
+	// packets read after the shutdown are refused
+	r, w, _ := os.Pipe()
+	defer w.Close()
+	sd.ParseTo(r, true)
+	_, err = r.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrClosed))
+}
+
+func TestStatsQ_ShutdownTimeout(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"shutdown-timeout": "100ms"}))
+	assert.Equal(t, 100*time.Millisecond, sd.ShutdownTimeout())
+	bb := &blockingBackend{flushing: make(chan bool), release: make(chan bool)}
+	defer close(bb.release)
+	sd.Window.Routes = []Route{NewRoute(bb, FilterList{})}
+	err := sd.Shutdown()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	other := NewStatsQ(NewPreCfg(map[string]string{"shutdown-timeout": "soon"}))
+	assert.Equal(t, DEFAULT_SHUTDOWN_TIMEOUT, other.ShutdownTimeout())
+}
+
+func TestStatsQ_RunStopsOnSignal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	pre := map[string]string{
+		"address":     "127.0.0.1:0",
+		"unix-socket": filepath.Join(dir, "statsq-stream.sock"),
+		"backends":    "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	res := make(chan error)
+	go func() {
+		res <- sd.Run()
+	}()
+	c := dialUnix(t, "unix", pre["unix-socket"])
+	defer c.Close()
+	sd.Signalchan <- syscall.SIGTERM
+	select {
+	case err := <-res:
+		assert.NoError(t, err)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("Run did not return")
+	}
+	// the listener and its connections are closed
+	_, err := os.Stat(pre["unix-socket"])
+	assert.True(t, os.IsNotExist(err))
+	c.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestStatsQ_RunFailsOnInvalidSettings(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{
+		"address":               "127.0.0.1:0",
+		"backends":              "log",
+		"timer-sketch-accuracy": "1",
+	}))
+	assert.EqualError(t, sd.Run(), "invalid settings: timer-sketch-accuracy 1 not in (0,1), fall back to 0.01")
+}
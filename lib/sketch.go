@@ -0,0 +1,179 @@
+package statsq
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	SKETCH_DEFAULT_ACCURACY = 0.01
+	SKETCH_DEFAULT_MAX_BINS = 2048
+)
+
+// DDSketch is a mergeable quantile sketch with a relative error guarantee (see "DDSketch: A fast and fully-mergeable
+// quantile sketch with relative-error guarantees", Masson et al.).
+// Values are counted in logarithmically sized bins, so a quantile is off by at most the accuracy (e.g. 1%) of its value,
+// while the memory is bounded by maxBins per sign. If more bins are needed, the ones holding the smallest magnitudes
+// are collapsed, which only affects the accuracy of the lowest quantiles.
+type DDSketch struct {
+	accuracy float64
+	gamma    float64
+	lnGamma  float64
+	maxBins  int
+	pos      *ddBins
+	neg      *ddBins
+	zeros    float64
+	count    float64
+	sum      float64
+	min      float64
+	max      float64
+}
+
+func NewDDSketch(accuracy float64, maxBins int) *DDSketch {
+	if accuracy <= 0 || accuracy >= 1 {
+		accuracy = SKETCH_DEFAULT_ACCURACY
+	}
+	if maxBins <= 0 {
+		maxBins = SKETCH_DEFAULT_MAX_BINS
+	}
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &DDSketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		lnGamma:  math.Log(gamma),
+		maxBins:  maxBins,
+		pos:      newDDBins(),
+		neg:      newDDBins(),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+func (s *DDSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+func (s *DDSketch) value(idx int) float64 {
+	return 2 * math.Pow(s.gamma, float64(idx)) / (s.gamma + 1)
+}
+
+// Add counts the value once.
+func (s *DDSketch) Add(v float64) {
+	switch {
+	case v > 0:
+		s.pos.add(s.index(v), 1, s.maxBins)
+	case v < 0:
+		s.neg.add(s.index(-v), 1, s.maxBins)
+	default:
+		s.zeros++
+	}
+	s.count++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+// ddBins counts the values of one sign by the index of their bin.
+type ddBins struct {
+	counts map[int]float64
+	// min is the lowest index, which the bins below are collapsed into
+	min int
+}
+
+func newDDBins() *ddBins {
+	return &ddBins{counts: map[int]float64{}}
+}
+
+// add counts c in the bin idx. If that would exceed maxBins, the lowest bin is collapsed into the next one,
+// or c into the lowest bin if idx is lower. Once collapsing, min only grows, so that looking for the next
+// index costs at most the range of the indexes over the lifetime of the sketch.
+func (b *ddBins) add(idx int, c float64, maxBins int) {
+	n := len(b.counts)
+	b.counts[idx] += c
+	if len(b.counts) == n {
+		return
+	}
+	if n == 0 || idx < b.min {
+		if n < maxBins {
+			b.min = idx
+			return
+		}
+		delete(b.counts, idx)
+		b.counts[b.min] += c
+		return
+	}
+	if n < maxBins {
+		return
+	}
+	low := b.counts[b.min]
+	delete(b.counts, b.min)
+	for {
+		b.min++
+		if _, ok := b.counts[b.min]; ok {
+			break
+		}
+	}
+	b.counts[b.min] += low
+}
+
+// Merge adds the values of another sketch, which has to be created with the same accuracy.
+func (s *DDSketch) Merge(o *DDSketch) {
+	for k, c := range o.pos.counts {
+		s.pos.add(k, c, s.maxBins)
+	}
+	for k, c := range o.neg.counts {
+		s.neg.add(k, c, s.maxBins)
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+	s.sum += o.sum
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+}
+
+// Quantile returns the estimated value at q (0 <= q <= 1).
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	rank := q * (s.count - 1)
+	var cum float64
+	keys := sortedBins(s.neg.counts)
+	for i := len(keys) - 1; i >= 0; i-- {
+		cum += s.neg.counts[keys[i]]
+		if cum > rank {
+			return s.clamp(-s.value(keys[i]))
+		}
+	}
+	cum += s.zeros
+	if cum > rank {
+		return 0
+	}
+	for _, k := range sortedBins(s.pos.counts) {
+		cum += s.pos.counts[k]
+		if cum > rank {
+			return s.clamp(s.value(k))
+		}
+	}
+	return s.max
+}
+
+func (s *DDSketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+func (s *DDSketch) Accuracy() float64 { return s.accuracy }
+func (s *DDSketch) Count() float64    { return s.count }
+func (s *DDSketch) Sum() float64      { return s.sum }
+func (s *DDSketch) Min() float64      { return s.min }
+func (s *DDSketch) Max() float64      { return s.max }
+func (s *DDSketch) Bins() int         { return len(s.pos.counts) + len(s.neg.counts) }
+
+func sortedBins(bins map[int]float64) []int {
+	keys := make([]int, 0, len(bins))
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
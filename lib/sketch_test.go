@@ -0,0 +1,193 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestDDSketch_Quantile(t *testing.T) {
+	r := rand.New(rand.NewSource(438))
+	s := NewDDSketch(0.01, 0)
+	values := []float64{}
+	for i := 0; i < 100000; i++ {
+		v := r.ExpFloat64() * 100
+		values = append(values, v)
+		s.Add(v)
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 0.999, 1} {
+		exp := exactQuantile(values, q)
+		got := s.Quantile(q)
+		assert.InEpsilon(t, exp, got, 0.01, "quantile %v", q)
+	}
+	assert.Equal(t, float64(100000), s.Count())
+	assert.Equal(t, values[0], s.Min())
+	assert.Equal(t, values[len(values)-1], s.Max())
+}
+
+func TestDDSketch_NegativeAndZero(t *testing.T) {
+	s := NewDDSketch(0.01, 0)
+	for _, v := range []float64{-100, -10, 0, 0, 10, 100} {
+		s.Add(v)
+	}
+	assert.Equal(t, float64(-100), s.Quantile(0))
+	assert.InEpsilon(t, -10, s.Quantile(0.2), 0.01)
+	assert.Equal(t, float64(0), s.Quantile(0.5))
+	assert.InEpsilon(t, 10, s.Quantile(0.8), 0.01)
+	assert.Equal(t, float64(100), s.Quantile(1))
+	assert.Equal(t, float64(0), s.Sum())
+	assert.True(t, math.IsNaN(NewDDSketch(0.01, 0).Quantile(0.5)))
+}
+
+func TestDDSketch_Merge(t *testing.T) {
+	a := NewDDSketch(0.01, 0)
+	b := NewDDSketch(0.01, 0)
+	all := NewDDSketch(0.01, 0)
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a.Add(float64(i))
+		} else {
+			b.Add(float64(i))
+		}
+		all.Add(float64(i))
+	}
+	a.Merge(b)
+	assert.Equal(t, all.Count(), a.Count())
+	assert.Equal(t, all.Sum(), a.Sum())
+	assert.Equal(t, float64(1), a.Min())
+	assert.Equal(t, float64(1000), a.Max())
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		assert.Equal(t, all.Quantile(q), a.Quantile(q))
+	}
+}
+
+func TestDDSketch_Collapse(t *testing.T) {
+	s := NewDDSketch(0.01, 64)
+	for i := 0; i < 10000; i++ {
+		s.Add(math.Pow(1.1, float64(i%500)))
+	}
+	assert.Equal(t, 64, s.Bins())
+	assert.Equal(t, float64(10000), s.Count())
+	// the upper quantiles are not affected by collapsing
+	assert.InEpsilon(t, math.Pow(1.1, 494), s.Quantile(0.99), 0.01)
+}
+
+func TestDDBins_Add(t *testing.T) {
+	b := newDDBins()
+	for _, idx := range []int{5, 3, 8, 1} {
+		b.add(idx, 1, 4)
+	}
+	assert.Equal(t, 1, b.min)
+	// the lowest bin is collapsed into the next one, lower indexes into the lowest bin
+	b.add(10, 1, 4)
+	assert.Equal(t, map[int]float64{3: 2, 5: 1, 8: 1, 10: 1}, b.counts)
+	b.add(0, 1, 4)
+	b.add(8, 1, 4)
+	assert.Equal(t, map[int]float64{3: 3, 5: 1, 8: 2, 10: 1}, b.counts)
+	b.add(9, 1, 4)
+	assert.Equal(t, map[int]float64{5: 4, 8: 2, 9: 1, 10: 1}, b.counts)
+	assert.Equal(t, 5, b.min)
+}
+
+func TestStatsQTimerSketch(t *testing.T) {
+	pre := map[string]string{
+		"timer-sketch":          "^sketched\\.",
+		"timer-sketch-accuracy": "0.02",
+		"percentiles":           "90,-10",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	for i := 1; i <= 100; i++ {
+		sd.HandlerStatsdPacket(qtypes.NewStatsdPacket("sketched.timer", "1", "ms"))
+	}
+	sd.ParseLine("raw.timer:1|ms")
+	gid := GenID("sketched.timer")
+	assert.Len(t, sd.Timers[gid], 0)
+	assert.Equal(t, float64(100), sd.Sketches[gid].Count())
+	assert.Equal(t, 0.02, sd.Sketches[gid].Accuracy())
+	assert.Len(t, sd.Timers[GenID("raw.timer")], 1)
+	sd.FanOutTimers(time.Unix(1495028544, 0))
+	exp := map[string]float64{
+		"sketched.timer.upper_90": 1.0,
+		"sketched.timer.lower_10": 1.0,
+		"sketched.timer.mean":     1.0,
+		"sketched.timer.upper":    1.0,
+		"sketched.timer.lower":    1.0,
+		"sketched.timer.count":    100.0,
+		"raw.timer.count":         1.0,
+	}
+	tr := NewTimerResult(exp)
+	for !tr.Check() {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			tr.Input(met.Name, met.Value)
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal(tr.Result())
+		}
+	}
+	assert.Len(t, sd.Sketches, 0)
+}
+
+func benchmarkSamples(n int) []float64 {
+	r := rand.New(rand.NewSource(438))
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = float64(r.Uint32() % 1000)
+	}
+	return samples
+}
+
+func BenchmarkTimerSort(b *testing.B) {
+	samples := benchmarkSamples(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timer := make(Float64Slice, 0)
+		for _, v := range samples {
+			timer = append(timer, v)
+		}
+		sort.Sort(timer)
+		_ = timer[int(0.99*float64(len(timer)))]
+	}
+}
+
+func BenchmarkTimerSketch(b *testing.B) {
+	samples := benchmarkSamples(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewDDSketch(SKETCH_DEFAULT_ACCURACY, SKETCH_DEFAULT_MAX_BINS)
+		for _, v := range samples {
+			s.Add(v)
+		}
+		s.Quantile(0.99)
+	}
+}
+
+// BenchmarkDDSketchSaturated adds values spread over more bins than the sketch keeps, so that bins are collapsed.
+func BenchmarkDDSketchSaturated(b *testing.B) {
+	r := rand.New(rand.NewSource(438))
+	samples := make([]float64, 100000)
+	for i := range samples {
+		samples[i] = math.Exp(r.Float64() * 60)
+	}
+	s := NewDDSketch(SKETCH_DEFAULT_ACCURACY, SKETCH_DEFAULT_MAX_BINS)
+	for _, v := range samples {
+		s.Add(v)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Add(samples[i%len(samples)])
+	}
+}
@@ -2,6 +2,9 @@ package statsq
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/qnib/qframe-types"
 	"github.com/zpatrick/go-config"
@@ -14,6 +17,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -21,9 +25,13 @@ import (
 const (
 	MAX_UNPROCESSED_PACKETS = 1000
 	TCP_READ_SIZE           = 4096
+	ACCEPT_RETRY_DELAY      = time.Second
 	version = "0.1.1"
 )
 
+// StatsQ aggregates the packets received and flushes them to the backends. Its fields are set up by
+// NewNamedStatsQ or New; the windows, shards, bucket mappings and rules are owned by the goroutines started
+// by Start or Run and must not be read or changed afterwards, use the accessors instead.
 type StatsQ struct {
 	Name            string
 	Version			string
@@ -31,15 +39,42 @@ type StatsQ struct {
 	Signalchan      chan os.Signal
 	Cfg             *config.Config
 	In              chan *qtypes.StatsdPacket
-	Counters        map[string]float64
-	Gauges          map[string]float64
-	Timers          map[string]Float64Slice
-	CountInactivity map[string]int64
-	Sets            map[string][]string
+	*Window
+	Windows         []*Window
 	ReceiveCounter  string
 	QChan           qtypes.QChan
 	Percentiles     Percentiles
+	PercentileMethod string
 	BucketMapping   map[string]BucketID
+	GlobalDims      GlobalDimensions
+	IngestFilter    FilterList
+	Routes          []Route
+	SketchPatterns  BucketPatterns
+	HLLPatterns     BucketPatterns
+	GaugePatterns   map[string]BucketPatterns
+	GaugeResend     int
+	GaugeResendRules []GaugeResendRule
+	deleteGauges    bool
+	TopKRules       []*TopKRule
+	topKCache       map[string]*TopKRule
+	BucketOpts      map[string]BucketOptions
+	Derived         []DerivedMetric
+	Alerts          []*AlertRule
+	Notifier        *AlertNotifier
+	Shards          []*Shard
+	shard           *Shard
+	// forgotten holds the buckets dropped by the flushes since the last merge, for the shards to drop them as well
+	forgotten       []string
+	QueueSize       int
+	OverflowPolicy  string
+	SelfMetrics     string
+	ParseErrors     *ParseErrorCounter
+	// udpPort is the port of the UDP listener, to look up its overruns
+	udpPort         int64
+	udpDrops        uint64
+	life            *lifecycle
+	// cfgErrs holds the settings skipped or replaced by a default, which New fails on
+	cfgErrs         []error
 }
 
 func NewStatsQ(cfg *config.Config) StatsQ {
@@ -53,20 +88,58 @@ func NewNamedStatsQ(name string, cfg *config.Config, qchan qtypes.QChan) StatsQ
 		Parser:          MsgParser{debug: true},
 		Signalchan:      make(chan os.Signal, 1),
 		Cfg:             cfg,
-		In:              make(chan *qtypes.StatsdPacket, MAX_UNPROCESSED_PACKETS),
-		Counters:        make(map[string]float64),
-		Gauges:          make(map[string]float64),
-		Timers:          make(map[string]Float64Slice),
-		CountInactivity: make(map[string]int64),
-		Sets:            make(map[string][]string),
 		Percentiles:     Percentiles{},
 		QChan:           qchan,
 		BucketMapping:   map[string]BucketID{},
+		BucketOpts:      map[string]BucketOptions{},
+		topKCache:       map[string]*TopKRule{},
+		ParseErrors:     NewParseErrorCounter(),
+		life:            newLifecycle(),
 	}
 	sd.ReceiveCounter = sd.StringOr("receive-counter", "")
+	sd.SelfMetrics = sd.StringOr("self-metrics", "")
+	sd.QueueSize = sd.IntOr("queue-size", MAX_UNPROCESSED_PACKETS)
+	if sd.QueueSize < 1 {
+		sd.invalidSetting("warn", fmt.Sprintf("queue-size %d is not positive, fall back to %d", sd.QueueSize, MAX_UNPROCESSED_PACKETS))
+		sd.QueueSize = MAX_UNPROCESSED_PACKETS
+	}
+	sd.In = make(chan *qtypes.StatsdPacket, sd.QueueSize)
+	sd.OverflowPolicy = sd.StringOr("queue-overflow", OverflowBlock)
+	if !IsOverflowPolicy(sd.OverflowPolicy) {
+		sd.invalidSetting("warn", fmt.Sprintf("Unknown queue-overflow '%s', fall back to '%s'", sd.OverflowPolicy, OverflowBlock))
+		sd.OverflowPolicy = OverflowBlock
+	}
+	sd.GlobalDims = sd.NewGlobalDimensionsFromConfig()
+	sd.IngestFilter = sd.NewFilterListFromConfig("ingest-allow", "ingest-deny")
+	sd.Routes = sd.NewRoutesFromConfig()
+	sd.SketchPatterns = sd.bucketPatterns("timer-sketch")
+	sd.HLLPatterns = sd.bucketPatterns("set-hll")
+	sd.GaugePatterns = map[string]BucketPatterns{}
+	for _, policy := range GaugePolicies {
+		sd.GaugePatterns[policy] = sd.bucketPatterns("gauge-" + policy)
+	}
+	sd.GaugeResend, sd.GaugeResendRules = sd.NewGaugeResendFromConfig()
+	sd.deleteGauges = sd.Bool("delete-gauges") && !sd.Bool("resent-gauges")
+	sd.TopKRules = sd.NewTopKRulesFromConfig()
+	sd.Derived = sd.NewDerivedMetricsFromConfig()
+	sd.Alerts = sd.NewAlertRulesFromConfig()
+	sd.Notifier = &AlertNotifier{}
+	sd.Windows = sd.NewWindowsFromConfig()
+	// the first window is embedded, so that Counters, Gauges, ... refer to it
+	sd.Window = sd.Windows[0]
 	sd.Log("info", fmt.Sprintf("Pctls: %s", sd.StringOr("percentiles", "")))
 	for _, pctl := range strings.Split(sd.StringOr("percentiles", ""), ",") {
-		sd.Percentiles.Set(pctl)
+		if pctl == "" {
+			continue
+		}
+		if err := sd.Percentiles.Set(pctl); err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip percentile: %s", err.Error()))
+		}
+	}
+	sd.PercentileMethod = sd.StringOr("percentile-method", PercentileNearestRank)
+	if !IsPercentileMethod(sd.PercentileMethod) {
+		sd.invalidSetting("warn", fmt.Sprintf("Unknown percentile-method '%s', fall back to '%s'", sd.PercentileMethod, PercentileNearestRank))
+		sd.PercentileMethod = PercentileNearestRank
 	}
 	return sd
 }
@@ -83,6 +156,12 @@ func (sd *StatsQ) Log(logLevel, msg string) {
 	}
 }
 
+// invalidSetting logs a setting that is skipped or replaced by a default, for New to return it as error.
+func (sd *StatsQ) invalidSetting(logLevel, msg string) {
+	sd.Log(logLevel, msg)
+	sd.cfgErrs = append(sd.cfgErrs, errors.New(msg))
+}
+
 func (sd *StatsQ) StringOr(path, alt string) string {
 	if sd.Name != "" {
 		path = fmt.Sprintf("%s.%s", sd.Name, path)
@@ -124,15 +203,41 @@ func (sd *StatsQ) IntOr(path string, alt int) int {
 	return res
 }
 
+func (sd *StatsQ) FloatOr(path string, alt float64) float64 {
+	if sd.Name != "" {
+		path = fmt.Sprintf("%s.%s", sd.Name, path)
+	}
+	res, err := sd.Cfg.Float(path)
+	if err != nil {
+		res = alt
+	}
+	return res
+}
+
 func (sd *StatsQ) Int(path string) int {
 	return sd.IntOr(path, 0)
 }
 
-func (sd *StatsQ) Run() {
-	signal.Notify(sd.Signalchan, syscall.SIGTERM)
-	go sd.startUDPListener()
-	go sd.startTCPListener()
-	sd.LoopChannel()
+// Run starts the listeners and flushes the windows until SIGTERM or SIGINT is received, or Shutdown is called.
+// It returns once the packets received so far are flushed, with an error if a setting is invalid, a listener
+// could not be started or the final flush failed.
+func (sd *StatsQ) Run() error {
+	signal.Notify(sd.Signalchan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sd.Signalchan)
+	if err := sd.checkSettings(); err != nil {
+		return err
+	}
+	if err := sd.Start(context.Background()); err != nil {
+		return err
+	}
+	select {
+	case sig := <-sd.Signalchan:
+		sd.Log("info", fmt.Sprintf("Received %s, shutting down", sig))
+	case <-sd.life.closing:
+		// Shutdown was called, which returns its result
+		return nil
+	}
+	return sd.Shutdown()
 }
 
 // RelayMetrics listens for metrics on the QChan.Data channel and sends the metrics to the backends
@@ -140,52 +245,115 @@ func (sd *StatsQ) RelayMetrics() {
 
 }
 
-func (sd *StatsQ) startUDPListener() {
+// startUDPListener listens on the address configured, unless it is '-', and reads the packets in the background.
+func (sd *StatsQ) startUDPListener() error {
 	serviceAddress := sd.StringOr("address", ":8125")
-	address, _ := net.ResolveUDPAddr("udp", serviceAddress)
-	sd.Log("info", fmt.Sprintf("listening on %s", address))
-	listener, err := net.ListenUDP("udp", address)
+	if serviceAddress == "-" {
+		return nil
+	}
+	opts := sd.UDPOptionsFromConfig()
+	conns, err := ListenUDP(serviceAddress, opts)
 	if err != nil {
-		log.Fatalf("ERROR: ListenUDP - %s", err)
+		return fmt.Errorf("ListenUDP - %w", err)
 	}
-	sd.ParseTo(listener, false)
+	sd.Log("info", fmt.Sprintf("listening on %s (readers:%d, batch:%d)", conns[0].LocalAddr(), opts.Readers, opts.Batch))
+	atomic.StoreInt64(&sd.udpPort, int64(conns[0].LocalAddr().(*net.UDPAddr).Port))
+	sd.life.bind("address", conns[0].LocalAddr())
+	for _, conn := range conns {
+		go sd.ParseTo(NewUDPReader(conn, opts.Batch, opts.MaxPacketSize), false)
+	}
+	return nil
 }
 
-func (sd *StatsQ) startTCPListener() {
+func (sd *StatsQ) startTCPListener() error {
 	serviceAddress := sd.StringOr("tcpaddr", "")
 	if serviceAddress == "" {
-		return
+		return nil
 	}
-	address, _ := net.ResolveTCPAddr("tcp", serviceAddress)
-	log.Printf("listening on %s", address)
-	listener, err := net.ListenTCP("tcp", address)
+	tlsConfig, err := sd.TLSConfigFromConfig()
 	if err != nil {
-		log.Fatalf("ERROR: ListenTCP - %s", err)
+		return err
 	}
-	defer listener.Close()
+	listener, err := ListenTCP(serviceAddress, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("ListenTCP - %w", err)
+	}
+	if !sd.life.track(listener) {
+		return ErrStopped
+	}
+	log.Printf("listening on %s (tls:%v)", listener.Addr(), tlsConfig != nil)
+	sd.life.bind("tcpaddr", listener.Addr())
+	go sd.serveTCP(listener, sd.StringOr("tls-client-dimension", ""))
+	return nil
+}
 
+// serveTCP parses the lines of each connection accepted. The common name of the client certificate of TLS
+// connections is set as clientDim dimension, if not empty.
+func (sd *StatsQ) serveTCP(listener net.Listener, clientDim string) {
+	sd.serve(listener, func(conn net.Conn) {
+		if tc, ok := conn.(*tls.Conn); ok {
+			sd.serveTLS(tc, clientDim)
+			return
+		}
+		sd.ParseTo(conn, true)
+	})
+}
+
+// serve hands each connection accepted to handle in its own goroutine, until the listener is closed.
+// Accepting is retried after ACCEPT_RETRY_DELAY if it fails otherwise, e.g. because of too many open files.
+func (sd *StatsQ) serve(listener net.Listener, handle func(conn net.Conn)) {
+	defer listener.Close()
+	defer sd.life.untrack(listener)
 	for {
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Fatalf("ERROR: AcceptTCP - %s", err)
+			sd.Log("error", fmt.Sprintf("accepting on %s: %s", listener.Addr(), err.Error()))
+			time.Sleep(ACCEPT_RETRY_DELAY)
+			continue
 		}
-		go sd.ParseTo(conn, true)
+		go handle(conn)
 	}
 }
 
 func (sd *StatsQ) ParseTo(conn io.ReadCloser, partialReads bool) {
-	defer conn.Close()
-	maxUdpPacketSize := sd.Int("max-udp-packet-size")
+	maxUdpPacketSize := sd.IntOr("max-udp-packet-size", DEFAULT_MAX_UDP_PACKET_SIZE)
 	prefix := sd.String("prefix")
 	postfix := sd.String("postfix")
 	debug := sd.Bool("debug")
-	parser := NewParser(conn, partialReads, debug, maxUdpPacketSize, prefix, postfix)
+	sd.parseFrom(conn, NewParser(conn, partialReads, debug, maxUdpPacketSize, prefix, postfix))
+}
+
+// parseFrom dispatches the packets parsed from conn, until it is closed by the client or on shutdown.
+func (sd *StatsQ) parseFrom(conn io.ReadCloser, parser *MsgParser) {
+	defer conn.Close()
+	if !sd.life.enter() {
+		return
+	}
+	defer sd.life.exit()
+	if !sd.life.track(conn) {
+		return
+	}
+	defer sd.life.untrack(conn)
+	dr, _ := conn.(dimensionsReader)
 	sd.Log("debug", "Start ParseTo Loop")
 	for {
-		p, more := parser.Next()
+		p, more, err := parser.Next()
+		if err != nil {
+			sd.ParseErrors.Add(err)
+			sd.Log("debug", fmt.Sprintf("%s from %s", err.Error(), clientOf(conn)))
+		}
 		sd.Log("debug", fmt.Sprintf("Received: %v", p))
 		if p != nil {
-			sd.In <- p
+			if dr != nil {
+				// set by the connection, so they override the ones sent
+				for k, v := range dr.Dimensions() {
+					p.Dimensions.Map[k] = v
+				}
+			}
+			sd.Dispatch(p)
 		}
 		if !more {
 			break
@@ -193,109 +361,208 @@ func (sd *StatsQ) ParseTo(conn io.ReadCloser, partialReads bool) {
 	}
 }
 
+// flushTick asks LoopChannel to flush the interval of a window ending at end.
+type flushTick struct {
+	w   *Window
+	end time.Time
+}
+
+// LoopChannel aggregates the incoming packets in shards (at least one) and flushes the windows at each tick.
+// The shards swap their aggregation state at the tick and continue right away, while the previous interval
+// is merged, formatted and shipped to the backends by this goroutine.
+// On shutdown it flushes the packets received until then and returns.
 func (sd *StatsQ) LoopChannel() {
-	tickMs := sd.IntOr("send-metric-ms", 1000)
-	sd.Log("info", fmt.Sprintf("StatsQ ticker: %dms", tickMs))
-	ticker := time.NewTicker(time.Duration(tickMs) * time.Millisecond).C
+	if !sd.life.startLoop() {
+		return
+	}
+	if len(sd.Shards) == 0 {
+		sd.StartShards(sd.ShardCount())
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case sp := <-sd.In:
+				sd.HandlerStatsdPacket(sp)
+			case <-sd.life.stop:
+				return
+			}
+		}
+	}()
+	flush := make(chan flushTick)
+	for _, w := range sd.Windows {
+		sd.Log("info", fmt.Sprintf("StatsQ ticker: %s (aligned:%v)", w.Interval, w.Aligned))
+		w.Start = time.Now()
+		go sd.tickWindow(w, w.Start, flush)
+	}
 	for {
 		select {
-		case s := <-sd.In:
-			sd.HandlerStatsdPacket(s)
-		case <-ticker:
-			sd.FanOutMetrics()
+		case ft := <-flush:
+			sd.MergeShards(ft.w)
+			sd.FlushInterval(ft.w, ft.end)
+		case <-sd.life.stop:
+			<-drained
+			sd.finalFlush()
+			return
 		}
 	}
 }
 
-func (sd *StatsQ) HandlerStatsdPacket(sp *qtypes.StatsdPacket) {
-	if sd.ReceiveCounter != "" {
-		v, ok := sd.Counters[sd.ReceiveCounter]
-		if !ok || v < 0 {
-			sd.Counters[sd.ReceiveCounter] = 0
-		}
-		sd.Counters[sd.ReceiveCounter] += 1
-	}
-	bid := NewBucketID(sp.Bucket, sp.Dimensions)
-	bkey := bid.ID
-	_, ok := sd.BucketMapping[bkey]
-	if !ok {
-		log.Printf("Include bid '%s' w/ key '%s' in BucketMapping", bid.BucketName, bkey)
-		sd.BucketMapping[bkey] = bid
-	}
-	switch sp.Modifier {
-	case "ms":
-		_, ok := sd.Timers[bkey]
-		if !ok {
-			var t Float64Slice
-			sd.Timers[bkey] = t
-		}
-		sd.Timers[bkey] = append(sd.Timers[bkey], sp.ValFlt)
-	case "g":
-		gaugeValue, _ := sd.Gauges[bkey]
-		if sp.ValStr == "" {
-			gaugeValue = sp.ValFlt
-		} else if sp.ValStr == "+" {
-			// watch out for overflows
-			if sp.ValFlt > (math.MaxFloat64 - gaugeValue) {
-				gaugeValue = math.MaxFloat64
-			} else {
-				gaugeValue += sp.ValFlt
-			}
-		} else if sp.ValStr == "-" {
-			// subtract checking for negative numbers
-			if sp.ValFlt > gaugeValue {
-				gaugeValue = 0
-			} else {
-				gaugeValue -= sp.ValFlt
-			}
-		}
-		sd.Gauges[bkey] = gaugeValue
-	case "c":
-		_, ok := sd.Counters[bkey]
-		if !ok {
-			sd.Counters[bkey] = 0
+// tickWindow asks for the flushes of w, the first one following start. w.Start belongs to the flushing goroutine.
+func (sd *StatsQ) tickWindow(w *Window, start time.Time, flush chan<- flushTick) {
+	next := w.NextFlush(start)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-sd.life.stop:
+			return
 		}
-		sd.Counters[bkey] += sp.ValFlt * float64(1/sp.Sampling)
-	case "s":
-		_, ok := sd.Sets[bkey]
-		if !ok {
-			sd.Sets[bkey] = make([]string, 0)
+		select {
+		case flush <- flushTick{w, next}:
+		case <-sd.life.stop:
+			return
 		}
-		sd.Sets[bkey] = append(sd.Sets[bkey], sp.ValStr)
+		next = w.NextFlush(next)
+		timer.Reset(time.Until(next))
 	}
 }
 
-func (sd *StatsQ) FanOutMetrics() {
+// HandlerStatsdPacket aggregates the packet, or hands it to the shard owning its series.
+func (sd *StatsQ) HandlerStatsdPacket(sp *qtypes.StatsdPacket) {
+	if len(sd.Shards) > 0 {
+		sd.ShardFor(sp).Queue.Push(sp)
+		return
+	}
+	sd.localShard().Handle(sp)
+}
+
+// FanOutMetrics flushes all windows, returning the errors of the backends.
+func (sd *StatsQ) FanOutMetrics() error {
 	now := time.Now()
-	sd.FanOutCounters(now)
-	sd.FanOutGauges(now)
-	sd.FanOutSets(now)
-	sd.FanOutTimers(now)
+	errs := []error{}
+	for _, w := range sd.Windows {
+		sd.MergeShards(w)
+		errs = append(errs, sd.FlushWindow(w, now))
+	}
+	return errors.Join(errs...)
+}
 
+// FlushInterval finishes the interval of the window ending at end, stamping the metrics as configured.
+// The first interval of an aligned window is shorter than the others and dropped if partial-interval is 'discard'.
+func (sd *StatsQ) FlushInterval(w *Window, end time.Time) {
+	if w.IsPartial(end) && w.Partial == PartialDiscard {
+		sd.Log("info", fmt.Sprintf("Discard partial interval %s - %s", w.Start.Format(time.RFC3339), end.Format(time.RFC3339)))
+		w.Reset()
+	} else {
+		sd.FlushWindow(w, w.TimestampFor(end))
+	}
+	w.Start = end
+}
+
+// FlushLastInterval finishes the interval of the window cut short at now, e.g. by a shutdown. It is stamped like
+// the interval would have been by FlushInterval, or with now instead of its end, and never discarded as partial.
+func (sd *StatsQ) FlushLastInterval(w *Window, now time.Time) error {
+	ts := now
+	if w.Timestamp == TimestampStart {
+		ts = w.TimestampFor(w.NextFlush(w.Start))
+	}
+	err := sd.FlushWindow(w, ts)
+	w.Start = now
+	return err
+}
+
+// FlushWindow sends the aggregates of the window and flushes its backends.
+// Derived metrics are calculated once all aggregates of the interval are final,
+// alerts are evaluated and self-metrics sent on the first window only.
+func (sd *StatsQ) FlushWindow(w *Window, now time.Time) error {
+	alerts := len(sd.Alerts) > 0 && w == sd.Window
+	if len(sd.Derived) > 0 || alerts {
+		w.collect = MetricSet{}
+	}
+	sd.FanOutWindowCounters(w, now)
+	sd.FanOutWindowGauges(w, now)
+	sd.FanOutWindowSets(w, now)
+	sd.FanOutWindowTimers(w, now)
+	sd.FanOutWindowTopK(w, now)
+	if sd.SelfMetrics != "" && w == sd.Window {
+		sd.FanOutSelfMetrics(w, now)
+	}
+	if w.collect != nil {
+		sd.FanOutDerived(w, w.collect, now)
+		if alerts {
+			sd.EvaluateAlerts(w.collect, now)
+		}
+		w.collect = nil
+	}
+	return sd.FlushBackends(w.Routes)
 }
 
 func (sd *StatsQ) ParseLine(msg string) (err error) {
-	sp := sd.Parser.parseLine([]byte(msg))
-	sd.HandlerStatsdPacket(sp)
+	sp, err := sd.Parser.parseLine([]byte(msg))
+	if err != nil {
+		sd.ParseErrors.Add(err)
+		return err
+	}
+	if sp != nil {
+		sd.HandlerStatsdPacket(sp)
+	}
 	return
 }
 
+// dimensionsReader is implemented by connections that know more about the sender than its address, e.g. its
+// credentials. The dimensions are added to each packet read.
+type dimensionsReader interface {
+	Dimensions() map[string]string
+}
+
+// dimensionsConn is a connection along with the dimensions added to the packets read from it.
+type dimensionsConn struct {
+	net.Conn
+	dims map[string]string
+}
+
+func (c *dimensionsConn) Dimensions() map[string]string {
+	return c.dims
+}
+
+// clientOf returns the remote address of conn and the dimensions it adds, if there are any.
+func clientOf(conn io.Reader) string {
+	client := ""
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		client = c.RemoteAddr().String()
+	}
+	if dr, ok := conn.(dimensionsReader); ok && len(dr.Dimensions()) > 0 {
+		client = strings.TrimPrefix(client+" "+DimensionKey(dr.Dimensions()), " ")
+	}
+	if client == "" {
+		return "unknown client"
+	}
+	return client
+}
+
 func (sd *StatsQ) FanOutCounters(now time.Time) int64 {
+	return sd.FanOutWindowCounters(sd.Window, now)
+}
+
+func (sd *StatsQ) FanOutWindowCounters(w *Window, now time.Time) int64 {
 	var num int64
 	// continue sending zeros for counters for a short period of time even if we have no new data
-	for id, value := range sd.Counters {
+	for id, value := range w.Counters {
 		bid, ok := sd.BucketMapping[id]
 		if !ok {
 			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
 			return num
 		}
 		m := qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Counter, value, bid.Dimensions.Map, now, false)
-		sd.sendMetric(m)
-		delete(sd.Counters, id)
-		sd.CountInactivity[id] = 0
+		sd.sendMetric(w, m)
+		delete(w.Counters, id)
+		w.CountInactivity[id] = 0
 		num++
 	}
-	for id, purgeCount := range sd.CountInactivity {
+	for id, purgeCount := range w.CountInactivity {
 		bid, ok := sd.BucketMapping[id]
 		if !ok {
 			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
@@ -303,39 +570,77 @@ func (sd *StatsQ) FanOutCounters(now time.Time) int64 {
 		}
 		if purgeCount > 0 {
 			m := qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Counter, 0.0, bid.Dimensions.Map, now, false)
-			sd.sendMetric(m)
+			sd.sendMetric(w, m)
 			num++
 		}
-		sd.CountInactivity[id] += 1
-		if sd.CountInactivity[id] > int64(sd.Int("persist-count-keys")) {
-			delete(sd.CountInactivity, id)
+		w.CountInactivity[id] += 1
+		if w.CountInactivity[id] > int64(sd.Int("persist-count-keys")) {
+			delete(w.CountInactivity, id)
 		}
 	}
 	return num
 }
 
 func (sd *StatsQ) FanOutGauges(now time.Time) int64 {
+	return sd.FanOutWindowGauges(sd.Window, now)
+}
+
+func (sd *StatsQ) FanOutWindowGauges(w *Window, now time.Time) int64 {
 	var num int64
-	for id, currentValue := range sd.Gauges {
+	for id, currentValue := range w.Gauges {
 		bid, ok := sd.BucketMapping[id]
 		if !ok {
 			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
 			return num
 		}
+		delete(w.GaugeStats, id)
+		opts, ok := sd.BucketOpts[id]
+		if !ok {
+			opts = sd.OptionsFor(bid.BucketName)
+		}
+		// suppress gauges that were not updated for more intervals than they are resent; only windows aggregated
+		// themselves get here, merged ones forget a gauge once its resend budget is used up
+		inactive := w.GaugeInactivity[id]
+		if opts.GaugeResend != GAUGE_RESEND_FOREVER && inactive > opts.GaugeResend {
+			continue
+		}
+		w.GaugeInactivity[id] = inactive + 1
 		m := qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Gauge, currentValue, bid.Dimensions.Map, now, false)
-		sd.sendMetric(m)
+		sd.sendMetric(w, m)
 		num++
-		if sd.Bool("delete-gauges") {
+		if opts.GaugeDelete {
 			sd.Log("info", fmt.Sprintf("Delete gauges with id '%s'", id))
-			delete(sd.Gauges, id)
+			delete(w.Gauges, id)
+			delete(w.GaugeInactivity, id)
+		} else if len(sd.Shards) > 0 && opts.GaugeResend != GAUGE_RESEND_FOREVER && inactive >= opts.GaugeResend {
+			sd.forgetGauge(w, id)
 		}
 	}
 	return num
 }
 
+// forgetGauge drops a gauge that is not resent anymore from the merged window w, and its bucket once no window
+// holds a series of it. The shard keeps the value for relative updates and announces the bucket again with the next one.
+func (sd *StatsQ) forgetGauge(w *Window, id string) {
+	delete(w.Gauges, id)
+	delete(w.GaugeInactivity, id)
+	for _, o := range sd.Windows {
+		if o.holds(id) {
+			return
+		}
+	}
+	delete(sd.BucketMapping, id)
+	delete(sd.BucketOpts, id)
+	sd.forgotten = append(sd.forgotten, id)
+}
+
 func (sd *StatsQ) FanOutSets(now time.Time) int64 {
-	num := int64(len(sd.Sets))
-	for id, set := range sd.Sets {
+	return sd.FanOutWindowSets(sd.Window, now)
+}
+
+func (sd *StatsQ) FanOutWindowSets(w *Window, now time.Time) int64 {
+	num := int64(len(w.Sets) + len(w.HLLSets))
+	for id, set := range w.Sets {
 		bid, ok := sd.BucketMapping[id]
 		if !ok {
 			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
@@ -346,16 +651,35 @@ func (sd *StatsQ) FanOutSets(now time.Time) int64 {
 			uniqueSet[str] = true
 		}
 		m := qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Gauge, float64(len(uniqueSet)), bid.Dimensions.Map, now, false)
-		sd.sendMetric(m)
-		delete(sd.Sets, id)
+		sd.sendMetric(w, m)
+		delete(w.Sets, id)
+	}
+	for id, hll := range w.HLLSets {
+		bid, ok := sd.BucketMapping[id]
+		if !ok {
+			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
+			return num
+		}
+		count := math.Round(hll.Count())
+		m := qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Gauge, count, bid.Dimensions.Map, now, false)
+		sd.sendMetric(w, m)
+		// standard error of the estimate
+		name := fmt.Sprintf("%s.error", bid.BucketName)
+		m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, count*hll.RelativeError(), bid.Dimensions.Map, now, false)
+		sd.sendMetric(w, m)
+		delete(w.HLLSets, id)
 	}
 	return num
 }
 
 func (sd *StatsQ) FanOutTimers(now time.Time) int64 {
+	return sd.FanOutWindowTimers(sd.Window, now)
+}
+
+func (sd *StatsQ) FanOutWindowTimers(w *Window, now time.Time) int64 {
 	var num int64
 	//postfix := sd.String("postfix")
-	for id, timer := range sd.Timers {
+	for id, timer := range w.Timers {
 		bid, ok := sd.BucketMapping[id]
 		if !ok {
 			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
@@ -367,7 +691,6 @@ func (sd *StatsQ) FanOutTimers(now time.Time) int64 {
 		sort.Sort(timer)
 		min := timer[0]
 		max := timer[len(timer)-1]
-		maxAtThreshold := max
 		count := len(timer)
 
 		sum := float64(0)
@@ -376,53 +699,67 @@ func (sd *StatsQ) FanOutTimers(now time.Time) int64 {
 		}
 		mean := sum / float64(len(timer))
 
-		for _, pct := range sd.Percentiles {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.float >= 0 {
-					abs = pct.float
-				} else {
-					abs = 100 + pct.float
-				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.float >= 0 {
-					indexOfPerc -= 1 // index offset=0
-				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
-
-			var name string
-			if pct.float >= 0 {
-				name = fmt.Sprintf("%s.upper_%s", bid.BucketName, pct.str)
-			} else {
-				name = fmt.Sprintf("%s.lower_%s", bid.BucketName, pct.str[1:])
+		pctls := make([]float64, len(sd.Percentiles))
+		for i, pct := range sd.Percentiles {
+			pctls[i] = pct.Value(timer, sd.PercentileMethod)
+		}
+		sd.sendTimer(w, bid, now, pctls, mean, max, min, float64(count))
+		delete(w.Timers, id)
+	}
+	for id, sketch := range w.Sketches {
+		bid, ok := sd.BucketMapping[id]
+		if !ok {
+			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
+			return num
+		}
+		num++
+		pctls := make([]float64, len(sd.Percentiles))
+		for i, pct := range sd.Percentiles {
+			abs := pct.float
+			if pct.float < 0 {
+				abs = 100 + pct.float
 			}
-			m := qtypes.NewExt(sd.Name, name, qtypes.Gauge, maxAtThreshold, bid.GetDims(), now, false)
-			sd.sendMetric(m)
-		}
-
-		name := fmt.Sprintf("%s.mean", bid.BucketName)
-		m := qtypes.NewExt(sd.Name, name, qtypes.Gauge, mean, bid.GetDims(), now, false)
-		sd.sendMetric(m)
-		name = fmt.Sprintf("%s.upper", bid.BucketName)
-		m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, max, bid.GetDims(), now, false)
-		sd.sendMetric(m)
-		name = fmt.Sprintf("%s.lower", bid.BucketName)
-		m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, min, bid.GetDims(), now, false)
-		sd.sendMetric(m)
-		name = fmt.Sprintf("%s.count", bid.BucketName)
-		m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, float64(count), bid.GetDims(), now, false)
-		sd.sendMetric(m)
-		delete(sd.Timers, id)
+			pctls[i] = sketch.Quantile(abs / 100.0)
+		}
+		sd.sendTimer(w, bid, now, pctls, sketch.Sum()/sketch.Count(), sketch.Max(), sketch.Min(), sketch.Count())
+		delete(w.Sketches, id)
 	}
 	return num
 }
 
-func (sd *StatsQ) sendMetric(m qtypes.Metric) {
+// sendTimer sends the statistics of a timer, pctls holding the value for each of sd.Percentiles.
+func (sd *StatsQ) sendTimer(w *Window, bid BucketID, now time.Time, pctls []float64, mean, max, min, count float64) {
+	for i, pct := range sd.Percentiles {
+		var name string
+		if pct.float >= 0 {
+			name = fmt.Sprintf("%s.upper_%s", bid.BucketName, pct.str)
+		} else {
+			name = fmt.Sprintf("%s.lower_%s", bid.BucketName, pct.str[1:])
+		}
+		m := qtypes.NewExt(sd.Name, name, qtypes.Gauge, pctls[i], bid.GetDims(), now, false)
+		sd.sendMetric(w, m)
+	}
+
+	name := fmt.Sprintf("%s.mean", bid.BucketName)
+	m := qtypes.NewExt(sd.Name, name, qtypes.Gauge, mean, bid.GetDims(), now, false)
+	sd.sendMetric(w, m)
+	name = fmt.Sprintf("%s.upper", bid.BucketName)
+	m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, max, bid.GetDims(), now, false)
+	sd.sendMetric(w, m)
+	name = fmt.Sprintf("%s.lower", bid.BucketName)
+	m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, min, bid.GetDims(), now, false)
+	sd.sendMetric(w, m)
+	name = fmt.Sprintf("%s.count", bid.BucketName)
+	m = qtypes.NewExt(sd.Name, name, qtypes.Gauge, count, bid.GetDims(), now, false)
+	sd.sendMetric(w, m)
+}
+
+func (sd *StatsQ) sendMetric(w *Window, m qtypes.Metric) {
 	sd.Log("trace", m.ToOpenTSDB())
-	sd.QChan.Data.Send(m)
+	if w.collect != nil {
+		w.collect.Add(m)
+	}
+	w.Send(m)
 }
 
 func sanitizeBucket(bucket string) string {
@@ -506,7 +843,6 @@ func (sd *StatsQ) ProcessTimers(buffer *bytes.Buffer, now int64) int64 {
 		sort.Sort(timer)
 		min := timer[0]
 		max := timer[len(timer)-1]
-		maxAtThreshold := max
 		count := len(timer)
 
 		sum := float64(0)
@@ -516,21 +852,7 @@ func (sd *StatsQ) ProcessTimers(buffer *bytes.Buffer, now int64) int64 {
 		mean := sum / float64(len(timer))
 
 		for _, pct := range sd.Percentiles {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.float >= 0 {
-					abs = pct.float
-				} else {
-					abs = 100 + pct.float
-				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.float >= 0 {
-					indexOfPerc -= 1 // index offset=0
-				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
+			maxAtThreshold := pct.Value(timer, sd.PercentileMethod)
 
 			var tmpl string
 			var pctstr string
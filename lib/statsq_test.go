@@ -324,6 +324,174 @@ func TestStatsQFanOutGaugesDelete(t *testing.T) {
 	}
 }
 
+func TestStatsQFanOutGaugesDeleteResent(t *testing.T) {
+	// resent-gauges overrides delete-gauges, as does a rule resending a bucket
+	pre := map[string]string{
+		"statsd.delete-gauges":           "true",
+		"statsd.gauge-resend-rules":      "cpu",
+		"statsd.gauge-resend.cpu.bucket": "^cpu\\.",
+		"statsd.gauge-resend.cpu.mode":   "forever",
+	}
+	for resent, exp := range map[string]float64{"true": 50, "false": 0} {
+		pre["statsd.resent-gauges"] = resent
+		cfg := NewPreCfg(pre)
+		qchan := qtypes.NewQChan()
+		sd := NewNamedStatsQ("statsd", cfg, qchan)
+		qchan.Broadcast()
+		dc := qchan.Data.Join()
+		sd.ParseLine("testGauge:100|g")
+		sd.ParseLine("cpu.load:100|g")
+		now := time.Unix(1495028544, 0)
+		assert.Equal(t, int64(2), sd.FanOutGauges(now), resent)
+		for i := 0; i < 2; i++ {
+			<-dc.Read
+		}
+		sd.ParseLine("testGauge:-50|g")
+		sd.ParseLine("cpu.load:-50|g")
+		assert.Equal(t, int64(2), sd.FanOutGauges(now), resent)
+		for i := 0; i < 2; i++ {
+			select {
+			case val := <-dc.Read:
+				met := val.(qtypes.Metric)
+				if met.Name == "cpu.load" {
+					assert.Equal(t, float64(50), met.Value, resent)
+				} else {
+					assert.Equal(t, exp, met.Value, resent)
+				}
+			case <-time.After(1500 * time.Millisecond):
+				t.Fatal("metrics receive timeout")
+			}
+		}
+		// gauges kept are resent while inactive
+		if resent == "true" {
+			assert.Equal(t, int64(2), sd.FanOutGauges(now))
+		} else {
+			assert.Equal(t, int64(1), sd.FanOutGauges(now))
+		}
+	}
+}
+
+func TestStatsQFanOutGaugesResendOnce(t *testing.T) {
+	pre := map[string]string{"statsd.gauge-resend": "once"}
+	cfg := NewPreCfg(pre)
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("statsd", cfg, qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("testGauge:100|g")
+	gid := GenID("testGauge")
+	now := time.Unix(1495028544, 0)
+	assert.Equal(t, int64(1), sd.FanOutGauges(now))
+	select {
+	case val := <-dc.Read:
+		assert.IsType(t, qtypes.Metric{}, val)
+		met := val.(qtypes.Metric)
+		assert.Equal(t, float64(100), met.Value)
+		assert.Equal(t, "testGauge", met.Name)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("metrics receive timeout")
+	}
+	// inactive gauges are suppressed, but keep their value
+	assert.Equal(t, int64(0), sd.FanOutGauges(now))
+	assert.Equal(t, float64(100), sd.Gauges[gid])
+	sd.ParseLine("testGauge:-50|g")
+	assert.Equal(t, int64(1), sd.FanOutGauges(now))
+	select {
+	case val := <-dc.Read:
+		met := val.(qtypes.Metric)
+		assert.Equal(t, float64(50), met.Value)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("metrics receive timeout")
+	}
+}
+
+func TestStatsQFanOutGaugesResendIntervals(t *testing.T) {
+	pre := map[string]string{
+		"statsd.gauge-resend":              "forever",
+		"statsd.gauge-resend-rules":        "queue,cpu",
+		"statsd.gauge-resend.queue.bucket": "^queue\\.",
+		"statsd.gauge-resend.queue.mode":   "2",
+		"statsd.gauge-resend.cpu.bucket":   "^cpu\\.",
+		"statsd.gauge-resend.cpu.mode":     "once",
+	}
+	cfg := NewPreCfg(pre)
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("statsd", cfg, qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("queue.depth:100|g")
+	sd.ParseLine("cpu.load:1|g")
+	sd.ParseLine("mem.free:10|g")
+	now := time.Unix(1495028544, 0)
+	// written, then resent for two intervals
+	for _, exp := range []int64{3, 2, 2, 1, 1} {
+		assert.Equal(t, exp, sd.FanOutGauges(now))
+		for i := int64(0); i < exp; i++ {
+			select {
+			case <-dc.Read:
+			case <-time.After(1500 * time.Millisecond):
+				t.Fatal("metrics receive timeout")
+			}
+		}
+	}
+	sd.ParseLine("queue.depth:+1|g")
+	assert.Equal(t, int64(2), sd.FanOutGauges(now))
+	for i := 0; i < 2; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			if met.Name == "queue.depth" {
+				assert.Equal(t, float64(101), met.Value)
+			}
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+}
+
+func TestStatsQFanOutGaugesForgetMerged(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"gauge-resend": "1", "intervals": "10s,1m", "backends": "log"}))
+	sd.StartShards(2)
+	sd.ParseLine("queue.depth:100|g")
+	gid := GenID("queue.depth")
+	now := time.Unix(1495028544, 0)
+	short, long := sd.Windows[0], sd.Windows[1]
+	flush := func(w *Window) int64 {
+		sd.MergeShards(w)
+		return sd.FanOutWindowGauges(w, now)
+	}
+	// written and resent once, then dropped; the bucket is kept while the other window still resends it
+	assert.Equal(t, int64(1), flush(short))
+	assert.Equal(t, int64(1), flush(long))
+	assert.Equal(t, int64(1), flush(short))
+	assert.NotContains(t, short.Gauges, gid)
+	assert.NotContains(t, short.GaugeInactivity, gid)
+	assert.Contains(t, sd.BucketMapping, gid)
+	assert.Equal(t, int64(1), flush(long))
+	assert.Len(t, long.Gauges, 0)
+	assert.Len(t, sd.BucketMapping, 0)
+	assert.Len(t, sd.BucketOpts, 0)
+	// the shard drops the bucket with the next merge, but keeps the value for relative updates
+	assert.Equal(t, int64(0), flush(short))
+	for _, s := range sd.Shards {
+		assert.Len(t, s.BucketMapping, 0)
+		assert.Len(t, s.BucketOpts, 0)
+	}
+	sd.ParseLine("queue.depth:+5|g")
+	assert.Equal(t, int64(1), flush(short))
+	assert.Equal(t, float64(105), short.Gauges[gid])
+	assert.Contains(t, sd.BucketMapping, gid)
+	// updated before the shard dropped the bucket
+	flush(short)
+	flush(long)
+	flush(long)
+	assert.Len(t, sd.BucketMapping, 0)
+	sd.ParseLine("queue.depth:-5|g")
+	assert.Equal(t, int64(1), flush(short))
+	assert.Equal(t, float64(100), short.Gauges[gid])
+	assert.Contains(t, sd.BucketMapping, gid)
+}
+
 func TestStatsQFanOutSets(t *testing.T) {
 	cfg := NewCfg()
 	qchan := qtypes.NewQChan()
@@ -496,7 +664,7 @@ func TestStatsQFanOutTimersMorePercentiles(t *testing.T) {
 			met := val.(qtypes.Metric)
 			tr.Input(met.Name, met.Value)
 		case <-time.After(1500 * time.Millisecond):
-			fmt.Printf(tr.Result())
+			fmt.Println(tr.Result())
 			t.Fatal("timeout")
 		}
 		if tr.Check() {
@@ -0,0 +1,87 @@
+package statsq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// TLSConfigFromConfig reads tls-cert and tls-key, the certificate and key of the TCP listener, as well as
+// tls-client-ca, the CA client certificates are verified against. Without a certificate it returns nil.
+func (sd *StatsQ) TLSConfigFromConfig() (*tls.Config, error) {
+	certFile := sd.StringOr("tls-cert", "")
+	keyFile := sd.StringOr("tls-key", "")
+	caFile := sd.StringOr("tls-client-ca", "")
+	clientDim := sd.StringOr("tls-client-dimension", "")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" || clientDim != "" {
+			return nil, errors.New("tls-client-ca and tls-client-dimension need tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS needs both tls-cert and tls-key")
+	}
+	if clientDim != "" && caFile == "" {
+		return nil, errors.New("tls-client-dimension needs tls-client-ca to verify the client certificates")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading tls-cert/tls-key: %s", err.Error())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls-client-ca: %s", err.Error())
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in tls-client-ca '%s'", caFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ListenTCP listens on address, using TLS if tlsConfig is not nil.
+func ListenTCP(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+// serveTLS completes the handshake before parsing the lines, so that the common name of the verified client
+// certificate can be enforced as clientDim dimension.
+func (sd *StatsQ) serveTLS(conn *tls.Conn, clientDim string) {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		sd.Log("warn", fmt.Sprintf("TLS handshake with %s: %s", conn.RemoteAddr(), err.Error()))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	if clientDim == "" || len(state.PeerCertificates) == 0 {
+		sd.ParseTo(conn, true)
+		return
+	}
+	dims := map[string]string{clientDim: state.PeerCertificates[0].Subject.CommonName}
+	sd.ParseTo(&dimensionsConn{conn, dims}, true)
+}
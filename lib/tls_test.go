@@ -0,0 +1,180 @@
+package statsq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key, signed by itself if it is a CA.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and the key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestStatsQ_TLSConfigFromConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "statsq-ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "statsq", ca).write(t, dir, "server")
+
+	sd := NewStatsQ(NewPreCfg(map[string]string{}))
+	config, err := sd.TLSConfigFromConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	sd = NewStatsQ(NewPreCfg(map[string]string{"tls-cert": certFile, "tls-key": keyFile}))
+	config, err = sd.TLSConfigFromConfig()
+	assert.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	sd = NewStatsQ(NewPreCfg(map[string]string{"tls-cert": certFile, "tls-key": keyFile, "tls-client-ca": caFile}))
+	config, err = sd.TLSConfigFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	for _, pre := range []map[string]string{
+		{"tls-cert": certFile},
+		{"tls-client-ca": caFile},
+		{"tls-cert": certFile, "tls-key": keyFile, "tls-client-dimension": "client"},
+		{"tls-cert": certFile, "tls-key": certFile},
+		{"tls-cert": certFile, "tls-key": keyFile, "tls-client-ca": keyFile},
+	} {
+		sd = NewStatsQ(NewPreCfg(pre))
+		_, err = sd.TLSConfigFromConfig()
+		assert.Error(t, err, "%v", pre)
+	}
+}
+
+func TestStatsQ_ServeTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "statsq-ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "statsq", ca).write(t, dir, "server")
+	pre := map[string]string{
+		"tls-cert":             certFile,
+		"tls-key":              keyFile,
+		"tls-client-ca":        caFile,
+		"tls-client-dimension": "client",
+		"backends":             "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	config, err := sd.TLSConfigFromConfig()
+	assert.NoError(t, err)
+	listener, err := ListenTCP("127.0.0.1:0", config)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go sd.serveTCP(listener, "client")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// without a client certificate the connection is refused
+	c, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		c.Write([]byte("gorets:1|c\n"))
+		c.Close()
+	}
+	// a certificate signed by another CA is refused as well
+	other := newTestCert(t, "relay-2", newTestCert(t, "other-ca", nil))
+	c, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{other.tlsCertificate()}})
+	if err == nil {
+		c.Write([]byte("gorets:2|c\n"))
+		c.Close()
+	}
+
+	client := newTestCert(t, "relay-1", ca)
+	c, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tlsCertificate()}})
+	assert.NoError(t, err)
+	c.Write([]byte("gorets:3|c client=spoofed,dc=eu\n"))
+	c.Close()
+	sp := receivePacket(t, &sd)
+	assert.Equal(t, float64(3), sp.ValFlt)
+	assert.Equal(t, map[string]string{"client": "relay-1", "dc": "eu"}, sp.Dimensions.Map)
+}
+
+func TestStatsQ_ServeTLSWithoutClientCA(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "statsq-ca", nil)
+	certFile, keyFile := newTestCert(t, "statsq", ca).write(t, dir, "server")
+	sd := NewStatsQ(NewPreCfg(map[string]string{"tls-cert": certFile, "tls-key": keyFile, "backends": "log"}))
+	config, err := sd.TLSConfigFromConfig()
+	assert.NoError(t, err)
+	listener, err := ListenTCP("127.0.0.1:0", config)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go sd.serveTCP(listener, "")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	c, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+	assert.NoError(t, err)
+	c.Write([]byte("gorets:1|c host=a\n"))
+	c.Close()
+	sp := receivePacket(t, &sd)
+	assert.Equal(t, "gorets", sp.Bucket)
+	assert.Equal(t, map[string]string{"host": "a"}, sp.Dimensions.Map)
+}
@@ -0,0 +1,235 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TOPK_OTHER = "other"
+	// TOPK_CAPACITY_FACTOR times K values are tracked by default, to get the heavy hitters right
+	TOPK_CAPACITY_FACTOR = 10
+)
+
+// TopKRule folds the values of a dimension of counters matching a bucket pattern into the K heaviest and 'other'.
+type TopKRule struct {
+	Name      string
+	Bucket    *regexp.Regexp
+	Dimension string
+	K         int
+	Capacity  int
+}
+
+// TopKEntry is a value tracked by a SpaceSaving summary; Count overestimates the real count by at most Error.
+type TopKEntry struct {
+	Value string
+	Count float64
+	Error float64
+}
+
+// SpaceSaving keeps track of the heaviest values using a fixed number of counters (Metwally et al.).
+// If all counters are taken, the value with the lowest count is replaced and the new one inherits its count.
+type SpaceSaving struct {
+	capacity int
+	entries  map[string]*TopKEntry
+	total    float64
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSaving{
+		capacity: capacity,
+		entries:  map[string]*TopKEntry{},
+	}
+}
+
+// Add counts weight for value. Weights that are not positive, e.g. of decremented counters, are only added to
+// the total: the counters have to grow for the replaced minimum to bound the error, so they end up in 'other'.
+func (ss *SpaceSaving) Add(value string, weight float64) {
+	ss.total += weight
+	if weight <= 0 {
+		return
+	}
+	if e, ok := ss.entries[value]; ok {
+		e.Count += weight
+		return
+	}
+	if len(ss.entries) < ss.capacity {
+		ss.entries[value] = &TopKEntry{Value: value, Count: weight}
+		return
+	}
+	var min *TopKEntry
+	for _, e := range ss.entries {
+		if min == nil || e.Count < min.Count {
+			min = e
+		}
+	}
+	delete(ss.entries, min.Value)
+	ss.entries[value] = &TopKEntry{Value: value, Count: min.Count + weight, Error: min.Count}
+}
+
+// Top returns up to k entries ordered by count (descending).
+func (ss *SpaceSaving) Top(k int) []TopKEntry {
+	res := make([]TopKEntry, 0, len(ss.entries))
+	for _, e := range ss.entries {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count == res[j].Count {
+			return res[i].Value < res[j].Value
+		}
+		return res[i].Count > res[j].Count
+	})
+	if len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+// Merge adds the entries of another summary, e.g. of another shard. If more values than the capacity
+// are known afterwards, the ones with the lowest counts are dropped; they are still part of the total.
+func (ss *SpaceSaving) Merge(o *SpaceSaving) {
+	ss.total += o.total
+	for v, oe := range o.entries {
+		if e, ok := ss.entries[v]; ok {
+			e.Count += oe.Count
+			e.Error += oe.Error
+			continue
+		}
+		e := *oe
+		ss.entries[v] = &e
+	}
+	if len(ss.entries) <= ss.capacity {
+		return
+	}
+	keep := map[string]*TopKEntry{}
+	for _, e := range ss.Top(ss.capacity) {
+		keep[e.Value] = ss.entries[e.Value]
+	}
+	ss.entries = keep
+}
+
+// Total returns the sum of all weights added.
+func (ss *SpaceSaving) Total() float64 {
+	return ss.total
+}
+
+// TopK is the summary of one series for a rule.
+type TopK struct {
+	Rule *TopKRule
+	*SpaceSaving
+}
+
+// NewTopKRulesFromConfig reads the rules listed in topk from topk.<name>.{bucket,dimension,k,capacity}.
+func (sd *StatsQ) NewTopKRulesFromConfig() []*TopKRule {
+	rules := []*TopKRule{}
+	for _, name := range strings.Split(sd.String("topk"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		path := fmt.Sprintf("topk.%s", name)
+		re, err := regexp.Compile(sd.String(path + ".bucket"))
+		if err != nil {
+			sd.invalidSetting("error", fmt.Sprintf("Skip topk rule '%s': %s", name, err.Error()))
+			continue
+		}
+		rule := &TopKRule{
+			Name:      name,
+			Bucket:    re,
+			Dimension: sd.String(path + ".dimension"),
+			K:         sd.IntOr(path+".k", 10),
+		}
+		rule.Capacity = sd.IntOr(path+".capacity", TOPK_CAPACITY_FACTOR*rule.K)
+		if rule.Dimension == "" || rule.K < 1 || rule.Capacity < rule.K {
+			sd.invalidSetting("error", fmt.Sprintf("Skip topk rule '%s': needs a dimension, k>0 and capacity>=k", name))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// TopKRuleFor returns the first rule matching the bucket, or nil. The result is cached per bucket name.
+func (sd *StatsQ) TopKRuleFor(bucket string) *TopKRule {
+	return topKRuleFor(sd.TopKRules, sd.topKCache, bucket)
+}
+
+func topKRuleFor(rules []*TopKRule, cache map[string]*TopKRule, bucket string) *TopKRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	rule, ok := cache[bucket]
+	if ok {
+		return rule
+	}
+	for _, r := range rules {
+		if r.Bucket.MatchString(bucket) {
+			rule = r
+			break
+		}
+	}
+	cache[bucket] = rule
+	return rule
+}
+
+// handleTopK counts the packet in the summary of the series without the rule's dimension.
+func (s *Shard) handleTopK(rule *TopKRule, sp *qtypes.StatsdPacket, dims qtypes.Dimensions) {
+	reduced := qtypes.NewDimensions()
+	for k, v := range dims.Map {
+		if k != rule.Dimension {
+			reduced.Add(k, v)
+		}
+	}
+	bid := NewBucketID(sp.Bucket, reduced)
+	s.addBucket(bid)
+	for _, w := range s.Windows {
+		tk, ok := w.TopK[bid.ID]
+		if !ok {
+			tk = &TopK{Rule: rule, SpaceSaving: NewSpaceSaving(rule.Capacity)}
+			w.TopK[bid.ID] = tk
+		}
+		tk.Add(dims.Map[rule.Dimension], sp.ValFlt*float64(1/sp.Sampling))
+	}
+}
+
+// FanOutWindowTopK sends a counter for each of the K heaviest values and folds the remaining ones into 'other',
+// which is sent unless it is 0. It is negative if the values decremented outweigh the ones not among the K.
+func (sd *StatsQ) FanOutWindowTopK(w *Window, now time.Time) int64 {
+	var num int64
+	for id, tk := range w.TopK {
+		bid, ok := sd.BucketMapping[id]
+		if !ok {
+			sd.Log("error", fmt.Sprintf("Could not find BucketID for key '%s'", id))
+			return num
+		}
+		rest := tk.Total()
+		for _, e := range tk.Top(tk.Rule.K) {
+			sd.sendMetric(w, sd.topKMetric(bid, tk.Rule.Dimension, e.Value, e.Count, now))
+			rest -= e.Count
+			num++
+		}
+		// the entries are summed up in a different order than the total
+		if math.Abs(rest) > 1e-9*math.Abs(tk.Total()) {
+			sd.sendMetric(w, sd.topKMetric(bid, tk.Rule.Dimension, TOPK_OTHER, rest, now))
+			num++
+		}
+		delete(w.TopK, id)
+	}
+	return num
+}
+
+func (sd *StatsQ) topKMetric(bid BucketID, key, val string, count float64, now time.Time) qtypes.Metric {
+	dims := map[string]string{key: val}
+	for k, v := range bid.Dimensions.Map {
+		dims[k] = v
+	}
+	return qtypes.NewExt(sd.Name, bid.BucketName, qtypes.Counter, count, dims, now, false)
+}
@@ -0,0 +1,169 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	// values with a frequency above total/capacity are guaranteed to be kept
+	ss := NewSpaceSaving(10)
+	for i := 0; i < 100; i++ {
+		ss.Add("heavy", 1)
+		if i%2 == 0 {
+			ss.Add("medium", 1)
+		}
+		ss.Add("noise"+strconv.Itoa(i), 1)
+	}
+	assert.Equal(t, float64(250), ss.Total())
+	assert.Len(t, ss.entries, 10)
+	top := ss.Top(2)
+	assert.Len(t, top, 2)
+	assert.Equal(t, "heavy", top[0].Value)
+	assert.Equal(t, float64(100), top[0].Count)
+	assert.Equal(t, float64(0), top[0].Error)
+	assert.Equal(t, "medium", top[1].Value)
+	assert.True(t, top[1].Count-top[1].Error <= 50 && top[1].Count >= 50)
+	assert.Len(t, ss.Top(20), 10)
+	sum := float64(0)
+	for _, e := range ss.Top(10) {
+		sum += e.Count
+	}
+	assert.Equal(t, ss.Total(), sum, "counts of all entries add up to the total")
+}
+
+func TestSpaceSaving_Negative(t *testing.T) {
+	// decrements are only part of the total, they would let a replaced minimum shrink the error bound
+	ss := NewSpaceSaving(2)
+	ss.Add("a", 5)
+	ss.Add("b", 3)
+	ss.Add("a", -2)
+	ss.Add("c", -4)
+	assert.Equal(t, float64(2), ss.Total())
+	assert.Equal(t, []TopKEntry{{Value: "a", Count: 5}, {Value: "b", Count: 3}}, ss.Top(2))
+	ss.Add("c", 1)
+	assert.Equal(t, []TopKEntry{{Value: "a", Count: 5}, {Value: "c", Count: 4, Error: 3}}, ss.Top(2))
+}
+
+func TestSpaceSaving_Merge(t *testing.T) {
+	a := NewSpaceSaving(3)
+	b := NewSpaceSaving(3)
+	a.Add("x", 5)
+	a.Add("y", 3)
+	a.Add("z", 1)
+	b.Add("y", 4)
+	b.Add("w", 2)
+	b.Add("v", 1)
+	a.Merge(b)
+	assert.Equal(t, float64(16), a.Total())
+	assert.Len(t, a.entries, 3)
+	assert.Equal(t, []TopKEntry{{"y", 7, 0}, {"x", 5, 0}, {"w", 2, 0}}, a.Top(3))
+	// b is unchanged
+	assert.Len(t, b.entries, 3)
+}
+
+func TestNewTopKRulesFromConfig(t *testing.T) {
+	pre := map[string]string{
+		"topk":                     "customers,broken,nodim",
+		"topk.customers.bucket":    "^api\\.requests$",
+		"topk.customers.dimension": "customer",
+		"topk.customers.k":         "2",
+		"topk.broken.bucket":       "(",
+		"topk.nodim.bucket":        "x",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.TopKRules, 1)
+	rule := sd.TopKRules[0]
+	assert.Equal(t, 2, rule.K)
+	assert.Equal(t, 20, rule.Capacity)
+	assert.Equal(t, rule, sd.TopKRuleFor("api.requests"))
+	assert.Nil(t, sd.TopKRuleFor("api.requests.other"))
+	assert.Len(t, sd.topKCache, 2)
+}
+
+func TestTopKRulesFromConfigFile(t *testing.T) {
+	path, cleanup := writeTestConfig(t, "[topk.customers]\nbucket = ^api\\.requests$\ndimension = customer\nk = 2\n")
+	defer cleanup()
+	cfg, err := daemonConfig(t, "--config", path, "--topk", "customers")
+	assert.NoError(t, err)
+	sd := NewStatsQ(cfg)
+	assert.Len(t, sd.cfgErrs, 0)
+	assert.Len(t, sd.TopKRules, 1)
+	assert.Equal(t, "customer", sd.TopKRuleFor("api.requests").Dimension)
+	assert.Equal(t, 2, sd.TopKRules[0].K)
+}
+
+func TestStatsQFanOutTopK(t *testing.T) {
+	pre := map[string]string{
+		"topk":                     "customers",
+		"topk.customers.bucket":    "^api\\.requests$",
+		"topk.customers.dimension": "customer",
+		"topk.customers.k":         "2",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	sd.ParseLine("api.requests:10|c customer=acme,service=http")
+	sd.ParseLine("api.requests:5|c customer=initech,service=http")
+	sd.ParseLine("api.requests:1|c|@0.5 customer=globex,service=http")
+	sd.ParseLine("api.requests:1|c customer=hooli,service=http")
+	sd.ParseLine("api.requests:7|c service=http")
+	gid := GenID("api.requests_service=http")
+	assert.Len(t, sd.TopK, 1)
+	assert.Equal(t, float64(18), sd.TopK[gid].Total())
+	assert.Equal(t, float64(7), sd.Counters[gid])
+	num := sd.FanOutWindowTopK(sd.Window, time.Unix(1495028544, 0))
+	assert.Equal(t, int64(3), num)
+	got := map[string]float64{}
+	for i := 0; i < 3; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			assert.Equal(t, "api.requests", met.Name)
+			assert.Equal(t, qtypes.Counter, met.MetricType)
+			assert.Equal(t, "http", met.Dimensions["service"])
+			got[met.Dimensions["customer"]] = met.Value
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+	assert.Equal(t, map[string]float64{"acme": 10, "initech": 5, "other": 3}, got)
+	assert.Len(t, sd.TopK, 0)
+}
+
+func TestStatsQFanOutTopKOtherNegative(t *testing.T) {
+	pre := map[string]string{
+		"topk":                     "customers",
+		"topk.customers.bucket":    "^api\\.sessions$",
+		"topk.customers.dimension": "customer",
+		"topk.customers.k":         "1",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	// 'other' is sent whenever it is not 0, even if negative
+	sd.ParseLine("api.sessions:10|c customer=acme")
+	sd.ParseLine("api.sessions:2|c customer=initech")
+	sd.ParseLine("api.sessions:-5|c customer=initech")
+	sd.ParseLine("api.sessions:-1|c customer=acme")
+	assert.Equal(t, int64(2), sd.FanOutWindowTopK(sd.Window, time.Unix(1495028544, 0)))
+	got := map[string]float64{}
+	for i := 0; i < 2; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			got[met.Dimensions["customer"]] = met.Value
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+	assert.Equal(t, map[string]float64{"acme": 10, "other": -4}, got)
+	// nothing but the K values, 'other' is not sent
+	sd.ParseLine("api.sessions:3|c customer=acme")
+	assert.Equal(t, int64(1), sd.FanOutWindowTopK(sd.Window, time.Unix(1495028544, 0)))
+}
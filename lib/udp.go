@@ -0,0 +1,89 @@
+package statsq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	DEFAULT_MAX_UDP_PACKET_SIZE = 1472
+)
+
+// UDPOptions configure the sockets of the UDP listener.
+type UDPOptions struct {
+	// Readers is the number of sockets bound to the address using SO_REUSEPORT, each read by its own goroutine
+	Readers int
+	// ReceiveBuffer sets SO_RCVBUF of each socket, if positive
+	ReceiveBuffer int
+	// Batch is the number of datagrams read per recvmmsg call (Linux only), 1 reads them one by one
+	Batch int
+	// MaxPacketSize is the size of the read buffer for each datagram
+	MaxPacketSize int
+}
+
+// UDPOptionsFromConfig reads udp-readers, udp-rcvbuf, udp-batch and max-udp-packet-size.
+func (sd *StatsQ) UDPOptionsFromConfig() UDPOptions {
+	opts := UDPOptions{
+		Readers:       sd.IntOr("udp-readers", 1),
+		ReceiveBuffer: sd.IntOr("udp-rcvbuf", 0),
+		Batch:         sd.IntOr("udp-batch", 1),
+		MaxPacketSize: sd.IntOr("max-udp-packet-size", DEFAULT_MAX_UDP_PACKET_SIZE),
+	}
+	if opts.Readers < 1 {
+		opts.Readers = 1
+	}
+	if opts.Batch < 1 {
+		opts.Batch = 1
+	}
+	if opts.MaxPacketSize < 1 {
+		opts.MaxPacketSize = DEFAULT_MAX_UDP_PACKET_SIZE
+	}
+	return opts
+}
+
+// ListenUDP opens the sockets of the UDP listener. With more than one reader all sockets are bound to the
+// same port using SO_REUSEPORT, so that the kernel balances the datagrams between them.
+func ListenUDP(address string, opts UDPOptions) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if opts.Readers > 1 {
+		lc.Control = reusePort
+	}
+	conns := []*net.UDPConn{}
+	for i := 0; i < opts.Readers; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			closeUDP(conns)
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		if opts.ReceiveBuffer > 0 {
+			if err := conn.SetReadBuffer(opts.ReceiveBuffer); err != nil {
+				closeUDP(conns)
+				return nil, fmt.Errorf("setting SO_RCVBUF to %d: %s", opts.ReceiveBuffer, err.Error())
+			}
+		}
+		// bind the other sockets to the port of the first, in case it was picked by the kernel (e.g. ':0')
+		address = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+func closeUDP(conns []*net.UDPConn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// NewUDPReader returns a reader returning one datagram per Read call. If batch is larger than one
+// and the platform supports it, the datagrams are read batch at a time using recvmmsg.
+func NewUDPReader(conn *net.UDPConn, batch, maxPacketSize int) io.ReadCloser {
+	if batch > 1 {
+		if r, err := newBatchReader(conn, batch, maxPacketSize); err == nil {
+			return r
+		}
+	}
+	return conn
+}
@@ -0,0 +1,101 @@
+package statsq
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2). The padding after len on 64-bit architectures is added by the
+// alignment of Msghdr, so the layout matches the kernel on 32-bit architectures as well.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// batchReader reads up to len(bufs) datagrams per recvmmsg call and returns them one by one.
+type batchReader struct {
+	conn *net.UDPConn
+	raw  syscall.RawConn
+	bufs [][]byte
+	iovs []unix.Iovec
+	hdrs []mmsghdr
+	// next is the index of the next datagram to return, n the number of datagrams read
+	next, n int
+}
+
+func newBatchReader(conn *net.UDPConn, batch, maxPacketSize int) (*batchReader, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	br := &batchReader{
+		conn: conn,
+		raw:  raw,
+		bufs: make([][]byte, batch),
+		iovs: make([]unix.Iovec, batch),
+		hdrs: make([]mmsghdr, batch),
+	}
+	for i := range br.bufs {
+		br.bufs[i] = make([]byte, maxPacketSize)
+		br.iovs[i].Base = &br.bufs[i][0]
+		br.iovs[i].SetLen(maxPacketSize)
+		br.hdrs[i].hdr.Iov = &br.iovs[i]
+		br.hdrs[i].hdr.Iovlen = 1
+	}
+	return br, nil
+}
+
+// Read copies the next datagram into p, truncating it if p is too small.
+func (br *batchReader) Read(p []byte) (int, error) {
+	if br.next >= br.n {
+		if err := br.fill(); err != nil {
+			return 0, err
+		}
+	}
+	i := br.next
+	br.next++
+	return copy(p, br.bufs[i][:br.hdrs[i].len]), nil
+}
+
+func (br *batchReader) fill() error {
+	var n int
+	var errno syscall.Errno
+	err := br.raw.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&br.hdrs[0])), uintptr(len(br.hdrs)), 0, 0, 0)
+		if e == unix.EAGAIN {
+			// wait until the socket is readable
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	br.next, br.n = 0, n
+	return nil
+}
+
+func (br *batchReader) Close() error {
+	return br.conn.Close()
+}
@@ -0,0 +1,16 @@
+package statsq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+	"unsafe"
+)
+
+func TestMmsghdrLayout(t *testing.T) {
+	// the kernel pads struct mmsghdr to the alignment of the pointers in struct msghdr
+	ptr := unsafe.Sizeof(uintptr(0))
+	size := (unsafe.Sizeof(unix.Msghdr{}) + 4 + ptr - 1) / ptr * ptr
+	assert.Equal(t, size, unsafe.Sizeof(mmsghdr{}))
+	assert.Equal(t, unsafe.Sizeof(unix.Msghdr{}), unsafe.Offsetof(mmsghdr{}.len))
+}
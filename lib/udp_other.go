@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package statsq
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("multiple UDP readers need SO_REUSEPORT, which is only supported on Linux")
+}
+
+func newBatchReader(conn *net.UDPConn, batch, maxPacketSize int) (io.ReadCloser, error) {
+	return nil, errors.New("recvmmsg is only supported on Linux")
+}
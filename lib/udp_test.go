@@ -0,0 +1,79 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPOptionsFromConfig(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{}))
+	assert.Equal(t, UDPOptions{Readers: 1, Batch: 1, MaxPacketSize: DEFAULT_MAX_UDP_PACKET_SIZE}, sd.UDPOptionsFromConfig())
+	sd = NewStatsQ(NewPreCfg(map[string]string{"udp-readers": "4", "udp-rcvbuf": "4194304", "udp-batch": "64", "max-udp-packet-size": "8192"}))
+	assert.Equal(t, UDPOptions{Readers: 4, ReceiveBuffer: 4194304, Batch: 64, MaxPacketSize: 8192}, sd.UDPOptionsFromConfig())
+}
+
+func TestListenUDP(t *testing.T) {
+	conns, err := ListenUDP("127.0.0.1:0", UDPOptions{Readers: 3, ReceiveBuffer: 1 << 20})
+	assert.NoError(t, err)
+	defer closeUDP(conns)
+	assert.Len(t, conns, 3)
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	for _, c := range conns {
+		assert.Equal(t, port, c.LocalAddr().(*net.UDPAddr).Port)
+	}
+	// a second listener on the port without SO_REUSEPORT fails
+	_, err = ListenUDP(conns[0].LocalAddr().String(), UDPOptions{Readers: 1})
+	assert.Error(t, err)
+}
+
+func TestUDPBatchReader(t *testing.T) {
+	conns, err := ListenUDP("127.0.0.1:0", UDPOptions{Readers: 1})
+	assert.NoError(t, err)
+	r := NewUDPReader(conns[0], 8, 64)
+	defer r.Close()
+	client, err := net.Dial("udp", conns[0].LocalAddr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(client, "gorets:%d|c", i)
+	}
+	conns[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	for i := 0; i < 20; i++ {
+		n, err := r.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("gorets:%d|c", i), string(buf[:n]))
+	}
+}
+
+func TestStatsQUDPReaders(t *testing.T) {
+	pre := map[string]string{
+		"address":     "127.0.0.1:0",
+		"udp-readers": "2",
+		"udp-batch":   "16",
+		"backends":    "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	sd.StartShards(2)
+	assert.NoError(t, sd.startUDPListener())
+	defer sd.Shutdown()
+	deadline := time.Now().Add(2 * time.Second)
+	client, err := net.Dial("udp", sd.Addrs()["address"].String())
+	assert.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(client, "gorets:1|c\nhost%d:1|c", i%4)
+	}
+	gid := GenID("gorets")
+	var total float64
+	for time.Now().Before(deadline) && total < 100 {
+		time.Sleep(50 * time.Millisecond)
+		sd.MergeShards(sd.Window)
+		total = sd.Counters[gid]
+	}
+	assert.Equal(t, float64(100), total)
+	assert.Len(t, sd.Counters, 5)
+}
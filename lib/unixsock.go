@@ -0,0 +1,240 @@
+package statsq
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// UnixSocketOptions configure the socket files of the unix listeners.
+type UnixSocketOptions struct {
+	// Mode is applied to the socket file, if not zero
+	Mode os.FileMode
+	// Owner and Group are applied to the socket file, if not -1
+	Owner int
+	Group int
+	// PeerCred adds the pid and uid of the sending process as dimensions (Linux only)
+	PeerCred bool
+}
+
+// UnixSocketOptionsFromConfig reads unix-socket-mode (octal), unix-socket-owner, unix-socket-group (names or ids)
+// and unix-peercred.
+func (sd *StatsQ) UnixSocketOptionsFromConfig() (UnixSocketOptions, error) {
+	opts := UnixSocketOptions{
+		Owner:    -1,
+		Group:    -1,
+		PeerCred: sd.BoolOr("unix-peercred", false),
+	}
+	if mode := sd.StringOr("unix-socket-mode", ""); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return opts, fmt.Errorf("invalid unix-socket-mode '%s'", mode)
+		}
+		opts.Mode = os.FileMode(m)
+	}
+	if owner := sd.StringOr("unix-socket-owner", ""); owner != "" {
+		uid, err := lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return opts, fmt.Errorf("invalid unix-socket-owner '%s': %s", owner, err.Error())
+		}
+		opts.Owner = uid
+	}
+	if group := sd.StringOr("unix-socket-group", ""); group != "" {
+		gid, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return opts, fmt.Errorf("invalid unix-socket-group '%s': %s", group, err.Error())
+		}
+		opts.Group = gid
+	}
+	return opts, nil
+}
+
+// lookupID returns name if it is numeric, otherwise the id lookup returns for it.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// apply sets the permissions and ownership of the socket file.
+func (opts UnixSocketOptions) apply(path string) error {
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return err
+		}
+	}
+	if opts.Owner != -1 || opts.Group != -1 {
+		return os.Chown(path, opts.Owner, opts.Group)
+	}
+	return nil
+}
+
+// removeStaleSocket removes the socket file at path, left behind by a process that did not clean up.
+// It refuses to remove anything else than a socket, and a socket someone still listens on.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	for _, network := range []string{"unix", "unixgram"} {
+		if c, err := net.Dial(network, path); err == nil {
+			c.Close()
+			return fmt.Errorf("%s is in use", path)
+		}
+	}
+	return os.Remove(path)
+}
+
+// ListenUnixgram opens a datagram socket at path, replacing a stale socket file.
+func ListenUnixgram(path string, opts UnixSocketOptions) (*UnixgramReader, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	r := &UnixgramReader{conn: conn, path: path}
+	if err := opts.apply(path); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if opts.PeerCred {
+		if r.oob, err = passCred(conn); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ListenUnix opens a stream socket at path, replacing a stale socket file. The file is removed on Close.
+func ListenUnix(path string, opts UnixSocketOptions) (*net.UnixListener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// UnixgramReader returns one datagram per Read call, along with the credentials of its sender if enabled.
+type UnixgramReader struct {
+	conn *net.UnixConn
+	path string
+	// oob receives the SCM_CREDENTIALS message, nil if the credentials are not passed
+	oob  []byte
+	dims map[string]string
+}
+
+func (r *UnixgramReader) Read(p []byte) (int, error) {
+	if r.oob == nil {
+		return r.conn.Read(p)
+	}
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(p, r.oob)
+	if err != nil {
+		// n is -1 if the socket was closed
+		return 0, err
+	}
+	r.dims = credDimensions(r.oob[:oobn])
+	return n, nil
+}
+
+// Dimensions returns the pid and uid of the sender of the last datagram read.
+func (r *UnixgramReader) Dimensions() map[string]string {
+	return r.dims
+}
+
+// Close closes the socket and removes its file.
+func (r *UnixgramReader) Close() error {
+	err := r.conn.Close()
+	os.Remove(r.path)
+	return err
+}
+
+// LocalAddr returns the address of the socket.
+func (r *UnixgramReader) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+func (sd *StatsQ) startUnixgramListener() error {
+	path := sd.StringOr("unixgram-socket", "")
+	if path == "" {
+		return nil
+	}
+	opts, err := sd.UnixSocketOptionsFromConfig()
+	if err != nil {
+		return err
+	}
+	r, err := ListenUnixgram(path, opts)
+	if err != nil {
+		return fmt.Errorf("ListenUnixgram - %w", err)
+	}
+	sd.Log("info", fmt.Sprintf("listening on unixgram:%s (peercred:%v)", path, opts.PeerCred))
+	sd.life.bind("unixgram-socket", r.LocalAddr())
+	go sd.ParseTo(r, false)
+	return nil
+}
+
+func (sd *StatsQ) startUnixListener() error {
+	path := sd.StringOr("unix-socket", "")
+	if path == "" {
+		return nil
+	}
+	opts, err := sd.UnixSocketOptionsFromConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := ListenUnix(path, opts)
+	if err != nil {
+		return fmt.Errorf("ListenUnix - %w", err)
+	}
+	if !sd.life.track(listener) {
+		return ErrStopped
+	}
+	sd.Log("info", fmt.Sprintf("listening on unix:%s (peercred:%v)", path, opts.PeerCred))
+	sd.life.bind("unix-socket", listener.Addr())
+	go sd.serve(listener, func(conn net.Conn) {
+		if !opts.PeerCred {
+			sd.ParseTo(conn, true)
+			return
+		}
+		dims, err := peerCred(conn.(*net.UnixConn))
+		if err != nil {
+			sd.Log("error", fmt.Sprintf("reading SO_PEERCRED: %s", err.Error()))
+		}
+		sd.ParseTo(&dimensionsConn{conn, dims}, true)
+	})
+	return nil
+}
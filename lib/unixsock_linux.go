@@ -0,0 +1,68 @@
+package statsq
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+)
+
+// passCred enables SO_PASSCRED, so that each datagram comes with the credentials of its sender,
+// and returns a buffer large enough for them.
+func passCred(conn *net.UnixConn) ([]byte, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return make([]byte, unix.CmsgSpace(unix.SizeofUcred)), nil
+}
+
+// credDimensions returns the pid and uid of the SCM_CREDENTIALS message in oob.
+func credDimensions(oob []byte) map[string]string {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if cred, err := unix.ParseUnixCredentials(&msg); err == nil {
+			return ucredDimensions(cred)
+		}
+	}
+	return nil
+}
+
+// peerCred returns the pid and uid of the process connected to conn, using SO_PEERCRED.
+func peerCred(conn *net.UnixConn) (map[string]string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		cred, serr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return ucredDimensions(cred), nil
+}
+
+func ucredDimensions(cred *unix.Ucred) map[string]string {
+	return map[string]string{
+		"pid": strconv.Itoa(int(cred.Pid)),
+		"uid": strconv.Itoa(int(cred.Uid)),
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package statsq
+
+import (
+	"errors"
+	"net"
+)
+
+func passCred(conn *net.UnixConn) ([]byte, error) {
+	return nil, errors.New("passing the credentials of unix datagrams is only supported on Linux")
+}
+
+func credDimensions(oob []byte) map[string]string {
+	return nil
+}
+
+func peerCred(conn *net.UnixConn) (map[string]string, error) {
+	return nil, errors.New("SO_PEERCRED is only supported on Linux")
+}
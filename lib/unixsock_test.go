@@ -0,0 +1,134 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsq.sock")
+	assert.NoError(t, removeStaleSocket(path))
+	// a socket file left behind
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.NoError(t, err)
+	l.SetUnlinkOnClose(false)
+	assert.Error(t, removeStaleSocket(path), "socket in use")
+	l.Close()
+	assert.NoError(t, removeStaleSocket(path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	// a datagram socket in use
+	r, err := ListenUnixgram(path, UnixSocketOptions{Owner: -1, Group: -1})
+	assert.NoError(t, err)
+	assert.Error(t, removeStaleSocket(path))
+	r.Close()
+	// anything else
+	ioutil.WriteFile(path, []byte("data"), 0600)
+	assert.Error(t, removeStaleSocket(path))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestStatsQ_UnixSocketOptionsFromConfig(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"unix-socket-mode": "0620", "unix-socket-owner": "0", "unix-socket-group": "0", "unix-peercred": "true"}))
+	opts, err := sd.UnixSocketOptionsFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, UnixSocketOptions{Mode: 0620, Owner: 0, Group: 0, PeerCred: true}, opts)
+	sd = NewStatsQ(NewPreCfg(map[string]string{}))
+	opts, err = sd.UnixSocketOptionsFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, UnixSocketOptions{Owner: -1, Group: -1}, opts)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"unix-socket-mode": "0999"}))
+	_, err = sd.UnixSocketOptionsFromConfig()
+	assert.Error(t, err)
+	sd = NewStatsQ(NewPreCfg(map[string]string{"unix-socket-owner": "no-such-user-statsq"}))
+	_, err = sd.UnixSocketOptionsFromConfig()
+	assert.Error(t, err)
+}
+
+func TestListenUnixgram(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsq.sock")
+	r, err := ListenUnixgram(path, UnixSocketOptions{Mode: 0620, Owner: os.Getuid(), Group: os.Getgid(), PeerCred: true})
+	assert.NoError(t, err)
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0620), fi.Mode().Perm())
+	c, err := net.Dial("unixgram", path)
+	assert.NoError(t, err)
+	c.Write([]byte("gorets:1|c"))
+	c.Close()
+	buf := make([]byte, 100)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "gorets:1|c", string(buf[:n]))
+	assert.Equal(t, map[string]string{"pid": strconv.Itoa(os.Getpid()), "uid": strconv.Itoa(os.Getuid())}, r.Dimensions())
+	r.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func receivePacket(t *testing.T, sd *StatsQ) *qtypes.StatsdPacket {
+	select {
+	case sp := <-sd.In:
+		return sp
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("packet receive timeout")
+	}
+	return nil
+}
+
+// dialUnix retries until the listener started in the background has created the socket.
+func dialUnix(t *testing.T, network, path string) net.Conn {
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial(network, path); err == nil {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("could not connect to %s:%s", network, path)
+	return nil
+}
+
+func TestStatsQ_UnixListeners(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsq")
+	defer os.RemoveAll(dir)
+	pre := map[string]string{
+		"unixgram-socket": filepath.Join(dir, "statsq.sock"),
+		"unix-socket":     filepath.Join(dir, "statsq-stream.sock"),
+		"unix-peercred":   "true",
+		"backends":        "log",
+	}
+	sd := NewStatsQ(NewPreCfg(pre))
+	assert.NoError(t, sd.startUnixgramListener())
+	assert.NoError(t, sd.startUnixListener())
+	defer sd.Shutdown()
+	creds := map[string]string{"pid": strconv.Itoa(os.Getpid()), "uid": strconv.Itoa(os.Getuid())}
+
+	c := dialUnix(t, "unixgram", pre["unixgram-socket"])
+	c.Write([]byte("gorets:1|c host=a,uid=spoofed"))
+	c.Close()
+	sp := receivePacket(t, &sd)
+	assert.Equal(t, "gorets", sp.Bucket)
+	assert.Equal(t, map[string]string{"host": "a", "pid": creds["pid"], "uid": creds["uid"]}, sp.Dimensions.Map)
+
+	c = dialUnix(t, "unix", pre["unix-socket"])
+	c.Write([]byte("gaugor:1|g\ngaugor:2|g\n"))
+	c.Close()
+	for _, val := range []float64{1, 2} {
+		sp = receivePacket(t, &sd)
+		assert.Equal(t, "gaugor", sp.Bucket)
+		assert.Equal(t, val, sp.ValFlt)
+		assert.Equal(t, creds, sp.Dimensions.Map)
+	}
+}
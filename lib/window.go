@@ -0,0 +1,403 @@
+package statsq
+
+import (
+	"fmt"
+	"github.com/qnib/qframe-types"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampEnd stamps the metrics of an interval with its end (the flush time)
+	TimestampEnd = "end"
+	// TimestampStart stamps the metrics of an interval with its start
+	TimestampStart = "start"
+	// PartialFlush sends the first, partial interval of an aligned window like any other
+	PartialFlush = "flush"
+	// PartialDiscard drops what was received before the first aligned flush
+	PartialDiscard = "discard"
+)
+
+// Window aggregates the incoming packets for one flush interval and sends the results to its routes.
+// Each window keeps its own samples, so timer percentiles are computed over the full interval.
+type Window struct {
+	Name            string
+	Interval        time.Duration
+	Aligned         bool
+	Timestamp       string
+	Partial         string
+	Start           time.Time
+	Routes          []Route
+	Counters        map[string]float64
+	Gauges          map[string]float64
+	GaugeStats      map[string]*GaugeStat
+	GaugeInactivity map[string]int
+	Timers          map[string]Float64Slice
+	CountInactivity map[string]int64
+	Sets            map[string][]string
+	Sketches        map[string]*DDSketch
+	SketchAccuracy  float64
+	SketchMaxBins   int
+	HLLSets         map[string]*HyperLogLog
+	HLLPrecision    uint8
+	TopK            map[string]*TopK
+	// collect indexes the metrics of a flush for derived metrics
+	collect MetricSet
+}
+
+func NewWindow(name string, interval time.Duration, routes []Route) *Window {
+	return &Window{
+		Name:            name,
+		Interval:        interval,
+		Timestamp:       TimestampEnd,
+		Partial:         PartialFlush,
+		Start:           time.Now(),
+		Routes:          routes,
+		Counters:        make(map[string]float64),
+		Gauges:          make(map[string]float64),
+		GaugeStats:      make(map[string]*GaugeStat),
+		GaugeInactivity: make(map[string]int),
+		Timers:          make(map[string]Float64Slice),
+		CountInactivity: make(map[string]int64),
+		Sets:            make(map[string][]string),
+		Sketches:        make(map[string]*DDSketch),
+		SketchAccuracy:  SKETCH_DEFAULT_ACCURACY,
+		SketchMaxBins:   SKETCH_DEFAULT_MAX_BINS,
+		HLLSets:         make(map[string]*HyperLogLog),
+		HLLPrecision:    HLL_DEFAULT_PRECISION,
+		TopK:            make(map[string]*TopK),
+	}
+}
+
+// Handle aggregates a packet under the bucket key.
+func (w *Window) Handle(bkey string, opts BucketOptions, sp *qtypes.StatsdPacket) {
+	switch sp.Modifier {
+	case "ms":
+		if opts.TimerSketch {
+			sketch, ok := w.Sketches[bkey]
+			if !ok {
+				sketch = NewDDSketch(w.SketchAccuracy, w.SketchMaxBins)
+				w.Sketches[bkey] = sketch
+			}
+			sketch.Add(sp.ValFlt)
+			return
+		}
+		_, ok := w.Timers[bkey]
+		if !ok {
+			var t Float64Slice
+			w.Timers[bkey] = t
+		}
+		w.Timers[bkey] = append(w.Timers[bkey], sp.ValFlt)
+	case "g":
+		w.Gauges[bkey] = w.aggregateGauge(bkey, opts.GaugePolicy, sp)
+		w.GaugeInactivity[bkey] = 0
+	case "c":
+		_, ok := w.Counters[bkey]
+		if !ok {
+			w.Counters[bkey] = 0
+		}
+		w.Counters[bkey] += sp.ValFlt * float64(1/sp.Sampling)
+	case "s":
+		if opts.SetHLL {
+			hll, ok := w.HLLSets[bkey]
+			if !ok {
+				// the precision is validated in NewWindowsFromConfig
+				hll, _ = NewHyperLogLog(w.HLLPrecision)
+				w.HLLSets[bkey] = hll
+			}
+			hll.Add(sp.ValStr)
+			return
+		}
+		_, ok := w.Sets[bkey]
+		if !ok {
+			w.Sets[bkey] = make([]string, 0)
+		}
+		w.Sets[bkey] = append(w.Sets[bkey], sp.ValStr)
+	}
+}
+
+// GaugeStat keeps track of the values a gauge received within the current interval.
+type GaugeStat struct {
+	Count int64
+	Sum   float64
+	// Last is the value received last, which relative updates apply to
+	Last float64
+}
+
+// aggregateGauge returns the value of the gauge after receiving sp, according to the policy.
+// A relative update (+N/-N) applies to the value received last, or to the current value at the start of an
+// interval, and its result is aggregated like an absolute value. With the sum policy the update is added to
+// the sum instead, which already holds the value updated.
+func (w *Window) aggregateGauge(bkey, policy string, sp *qtypes.StatsdPacket) float64 {
+	cur := w.Gauges[bkey]
+	st, ok := w.GaugeStats[bkey]
+	if !ok {
+		st = &GaugeStat{Last: cur}
+		w.GaugeStats[bkey] = st
+	}
+	val := sp.ValFlt
+	switch sp.ValStr {
+	case "+":
+		// watch out for overflows
+		if sp.ValFlt > (math.MaxFloat64 - st.Last) {
+			val = math.MaxFloat64
+		} else {
+			val = st.Last + sp.ValFlt
+		}
+	case "-":
+		// gauges do not become negative by subtracting
+		if sp.ValFlt > st.Last {
+			val = 0
+		} else {
+			val = st.Last - sp.ValFlt
+		}
+	}
+	if policy == GaugeSum && sp.ValStr != "" && st.Count > 0 {
+		delta := val - st.Last
+		st.Sum += delta
+		st.Last = val
+		return cur + delta
+	}
+	st.Count++
+	st.Sum += val
+	st.Last = val
+	if st.Count == 1 {
+		return val
+	}
+	switch policy {
+	case GaugeFirst:
+		return cur
+	case GaugeMin:
+		return math.Min(cur, val)
+	case GaugeMax:
+		return math.Max(cur, val)
+	case GaugeAvg:
+		return st.Sum / float64(st.Count)
+	case GaugeSum:
+		return cur + val
+	}
+	return val
+}
+
+// Reset drops the samples of the current interval; gauges keep their value.
+func (w *Window) Reset() {
+	w.Counters = make(map[string]float64)
+	w.GaugeStats = make(map[string]*GaugeStat)
+	w.Timers = make(map[string]Float64Slice)
+	w.Sets = make(map[string][]string)
+	w.Sketches = make(map[string]*DDSketch)
+	w.HLLSets = make(map[string]*HyperLogLog)
+	w.TopK = make(map[string]*TopK)
+}
+
+// updated returns true if the bucket id got samples since the last snapshot or flush.
+func (w *Window) updated(id string) bool {
+	if _, ok := w.Gauges[id]; ok && w.GaugeInactivity[id] == 0 {
+		return true
+	}
+	_, counter := w.Counters[id]
+	_, timer := w.Timers[id]
+	_, set := w.Sets[id]
+	_, sketch := w.Sketches[id]
+	_, hll := w.HLLSets[id]
+	_, topk := w.TopK[id]
+	return counter || timer || set || sketch || hll || topk
+}
+
+// holds returns true if the window keeps a series of the bucket id, including gauges and counters that are resent.
+func (w *Window) holds(id string) bool {
+	_, gauge := w.Gauges[id]
+	_, counter := w.CountInactivity[id]
+	return gauge || counter || w.updated(id)
+}
+
+// clone returns an empty window with the settings of w, without routes.
+func (w *Window) clone() *Window {
+	c := NewWindow(w.Name, w.Interval, nil)
+	c.Aligned = w.Aligned
+	c.Timestamp = w.Timestamp
+	c.Partial = w.Partial
+	c.SketchAccuracy = w.SketchAccuracy
+	c.SketchMaxBins = w.SketchMaxBins
+	c.HLLPrecision = w.HLLPrecision
+	return c
+}
+
+// Snapshot moves the samples of the current interval into a new window, together with the gauges updated
+// since the last snapshot, and resets the window. Updated gauges are dropped if their options say so.
+func (w *Window) Snapshot(opts map[string]BucketOptions) *Window {
+	snap := w.clone()
+	snap.Counters = w.Counters
+	snap.Timers = w.Timers
+	snap.Sets = w.Sets
+	snap.Sketches = w.Sketches
+	snap.HLLSets = w.HLLSets
+	snap.TopK = w.TopK
+	for id, inactive := range w.GaugeInactivity {
+		if inactive > 0 {
+			continue
+		}
+		snap.Gauges[id] = w.Gauges[id]
+		snap.GaugeInactivity[id] = 0
+		w.GaugeInactivity[id] = 1
+		if opts[id].GaugeDelete {
+			delete(w.Gauges, id)
+			delete(w.GaugeInactivity, id)
+		}
+	}
+	w.Reset()
+	return snap
+}
+
+// Merge adds the samples of a snapshot; gauges of the snapshot overwrite the current values.
+func (w *Window) Merge(o *Window) {
+	for id, v := range o.Counters {
+		w.Counters[id] += v
+	}
+	for id, t := range o.Timers {
+		w.Timers[id] = append(w.Timers[id], t...)
+	}
+	for id, set := range o.Sets {
+		w.Sets[id] = append(w.Sets[id], set...)
+	}
+	for id, sketch := range o.Sketches {
+		if cur, ok := w.Sketches[id]; ok {
+			cur.Merge(sketch)
+		} else {
+			w.Sketches[id] = sketch
+		}
+	}
+	for id, hll := range o.HLLSets {
+		if cur, ok := w.HLLSets[id]; ok {
+			// windows share the precision, an error is not possible
+			cur.Merge(hll)
+		} else {
+			w.HLLSets[id] = hll
+		}
+	}
+	for id, tk := range o.TopK {
+		if cur, ok := w.TopK[id]; ok {
+			cur.Merge(tk.SpaceSaving)
+		} else {
+			w.TopK[id] = tk
+		}
+	}
+	for id, v := range o.Gauges {
+		w.Gauges[id] = v
+		w.GaugeInactivity[id] = o.GaugeInactivity[id]
+	}
+}
+
+// NextFlush returns the end of the interval following the flush at prev.
+// Aligned windows flush on multiples of the interval (since the zero time), so that :00, :10, :20 are used for 10s.
+func (w *Window) NextFlush(prev time.Time) time.Time {
+	if w.Aligned {
+		return prev.Truncate(w.Interval).Add(w.Interval)
+	}
+	return prev.Add(w.Interval)
+}
+
+// IsPartial returns true if the interval ending at end did not start on an interval boundary.
+func (w *Window) IsPartial(end time.Time) bool {
+	return w.Aligned && !w.Start.Equal(end.Add(-w.Interval))
+}
+
+// TimestampFor returns the timestamp used for the metrics of the interval ending at end.
+func (w *Window) TimestampFor(end time.Time) time.Time {
+	if w.Timestamp != TimestampStart {
+		return end
+	}
+	if w.Aligned {
+		return end.Add(-w.Interval)
+	}
+	return w.Start
+}
+
+// Send passes the metric to all routes of the window.
+func (w *Window) Send(m qtypes.Metric) {
+	for i := range w.Routes {
+		w.Routes[i].Send(m)
+	}
+}
+
+// NewWindowsFromConfig creates a window for each duration in intervals (e.g. '10s,1m'), sending to the backends
+// listed in interval.<duration>.backends (all backends if unset), e.g. 'backends' in an [interval.1m] section
+// of the config file.
+// Without intervals a single window ticking every send-metric-ms is used.
+// align-flushes, flush-timestamp, partial-interval, the timer-sketch and set-hll settings apply to all windows.
+func (sd *StatsQ) NewWindowsFromConfig() []*Window {
+	windows := []*Window{}
+	for _, name := range strings.Split(sd.String("intervals"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		interval, err := time.ParseDuration(name)
+		if err != nil || interval <= 0 {
+			sd.invalidSetting("error", fmt.Sprintf("Skip interval '%s': not a positive duration", name))
+			continue
+		}
+		windows = append(windows, NewWindow(name, interval, sd.routesByName(sd.String(fmt.Sprintf("interval.%s.backends", name)))))
+	}
+	if len(windows) == 0 {
+		tickMs := sd.IntOr("send-metric-ms", 1000)
+		windows = append(windows, NewWindow("", time.Duration(tickMs)*time.Millisecond, sd.Routes))
+	}
+	ts := sd.StringOr("flush-timestamp", TimestampEnd)
+	if ts != TimestampEnd && ts != TimestampStart {
+		sd.invalidSetting("warn", fmt.Sprintf("Unknown flush-timestamp '%s', fall back to '%s'", ts, TimestampEnd))
+		ts = TimestampEnd
+	}
+	partial := sd.StringOr("partial-interval", PartialFlush)
+	if partial != PartialFlush && partial != PartialDiscard {
+		sd.invalidSetting("warn", fmt.Sprintf("Unknown partial-interval '%s', fall back to '%s'", partial, PartialFlush))
+		partial = PartialFlush
+	}
+	precision := sd.IntOr("set-hll-precision", HLL_DEFAULT_PRECISION)
+	if precision < HLL_MIN_PRECISION || precision > HLL_MAX_PRECISION {
+		sd.invalidSetting("warn", fmt.Sprintf("set-hll-precision %d not in [%d,%d], fall back to %d", precision, HLL_MIN_PRECISION, HLL_MAX_PRECISION, HLL_DEFAULT_PRECISION))
+		precision = HLL_DEFAULT_PRECISION
+	}
+	accuracy := sd.FloatOr("timer-sketch-accuracy", SKETCH_DEFAULT_ACCURACY)
+	if !(accuracy > 0 && accuracy < 1) {
+		sd.invalidSetting("warn", fmt.Sprintf("timer-sketch-accuracy %v not in (0,1), fall back to %v", accuracy, SKETCH_DEFAULT_ACCURACY))
+		accuracy = SKETCH_DEFAULT_ACCURACY
+	}
+	maxBins := sd.IntOr("timer-sketch-max-bins", SKETCH_DEFAULT_MAX_BINS)
+	if maxBins < 1 {
+		sd.invalidSetting("warn", fmt.Sprintf("timer-sketch-max-bins %d is not positive, fall back to %d", maxBins, SKETCH_DEFAULT_MAX_BINS))
+		maxBins = SKETCH_DEFAULT_MAX_BINS
+	}
+	for _, w := range windows {
+		w.HLLPrecision = uint8(precision)
+		w.SketchAccuracy = accuracy
+		w.SketchMaxBins = maxBins
+		w.Aligned = sd.Bool("align-flushes")
+		w.Timestamp = ts
+		w.Partial = partial
+	}
+	return windows
+}
+
+// routesByName returns the routes of the comma separated backend names, or all routes if names is empty.
+func (sd *StatsQ) routesByName(names string) []Route {
+	if names == "" {
+		return sd.Routes
+	}
+	routes := []Route{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, r := range sd.Routes {
+			if r.Backend.Name() == name {
+				routes = append(routes, r)
+				found = true
+			}
+		}
+		if !found {
+			sd.invalidSetting("error", fmt.Sprintf("Unknown backend '%s'", name))
+		}
+	}
+	return routes
+}
@@ -0,0 +1,225 @@
+package statsq
+
+import (
+	"github.com/qnib/qframe-types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewWindowsFromConfig(t *testing.T) {
+	sd := NewStatsQ(NewPreCfg(map[string]string{"send-metric-ms": "500"}))
+	assert.Len(t, sd.Windows, 1)
+	assert.Equal(t, 500*time.Millisecond, sd.Window.Interval)
+	pre := map[string]string{
+		"backends":              "qchan,debug",
+		"backend.debug.type":    "log",
+		"intervals":             "10s,1m,broken,-1s",
+		"interval.1m.backends":  "debug,unknown",
+		"interval.10s.backends": "",
+	}
+	sd = NewStatsQ(NewPreCfg(pre))
+	assert.Len(t, sd.Windows, 2)
+	assert.Equal(t, sd.Windows[0], sd.Window)
+	assert.Equal(t, 10*time.Second, sd.Windows[0].Interval)
+	assert.Len(t, sd.Windows[0].Routes, 2)
+	assert.Equal(t, time.Minute, sd.Windows[1].Interval)
+	assert.Len(t, sd.Windows[1].Routes, 1)
+	assert.Equal(t, "debug", sd.Windows[1].Routes[0].Backend.Name())
+}
+
+func TestStatsQWindows(t *testing.T) {
+	pre := map[string]string{
+		"intervals":   "10s,1m",
+		"percentiles": "50",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	short, long := sd.Windows[0], sd.Windows[1]
+	now := time.Unix(1495028544, 0)
+	sd.ParseLine("testTimer:100|ms")
+	sd.ParseLine("testTimer:200|ms")
+	sd.FlushWindow(short, now)
+	exp := map[string]float64{
+		"testTimer.upper_50": 100.0,
+		"testTimer.upper":    200.0,
+		"testTimer.count":    2.0,
+	}
+	tr := NewTimerResult(exp)
+	for !tr.Check() {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			tr.Input(met.Name, met.Value)
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal(tr.Result())
+		}
+	}
+	assert.Len(t, short.Timers, 0)
+	assert.Len(t, long.Timers[GenID("testTimer")], 2)
+	sd.ParseLine("testTimer:300|ms")
+	sd.ParseLine("testTimer:400|ms")
+	sd.ParseLine("testTimer:500|ms")
+	sd.FlushWindow(long, now)
+	exp = map[string]float64{
+		"testTimer.upper_50": 300.0,
+		"testTimer.upper":    500.0,
+		"testTimer.count":    5.0,
+	}
+	tr = NewTimerResult(exp)
+	for !tr.Check() {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			tr.Input(met.Name, met.Value)
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal(tr.Result())
+		}
+	}
+	assert.Len(t, short.Timers[GenID("testTimer")], 3)
+	assert.Len(t, long.Timers, 0)
+}
+
+func TestWindow_NextFlush(t *testing.T) {
+	w := NewWindow("10s", 10*time.Second, nil)
+	start := time.Unix(1495028544, 300)
+	assert.Equal(t, start.Add(10*time.Second), w.NextFlush(start))
+	w.Aligned = true
+	assert.Equal(t, time.Unix(1495028550, 0), w.NextFlush(start))
+	assert.Equal(t, time.Unix(1495028560, 0), w.NextFlush(time.Unix(1495028550, 0)))
+}
+
+func TestWindow_TimestampFor(t *testing.T) {
+	w := NewWindow("10s", 10*time.Second, nil)
+	w.Start = time.Unix(1495028544, 0)
+	end := time.Unix(1495028550, 0)
+	assert.Equal(t, end, w.TimestampFor(end))
+	w.Timestamp = TimestampStart
+	assert.Equal(t, w.Start, w.TimestampFor(end))
+	w.Aligned = true
+	assert.Equal(t, time.Unix(1495028540, 0), w.TimestampFor(end))
+	assert.True(t, w.IsPartial(end))
+	w.Start = time.Unix(1495028540, 0)
+	assert.False(t, w.IsPartial(end))
+}
+
+func TestStatsQFlushIntervalPartial(t *testing.T) {
+	pre := map[string]string{
+		"intervals":        "10s",
+		"align-flushes":    "true",
+		"flush-timestamp":  "start",
+		"partial-interval": "discard",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	w := sd.Window
+	assert.True(t, w.Aligned)
+	w.Start = time.Unix(1495028544, 0)
+	sd.ParseLine("gorets:1|c")
+	sd.ParseLine("gaugor:1|g")
+	sd.FlushInterval(w, time.Unix(1495028550, 0))
+	assert.Len(t, w.Counters, 0)
+	assert.Len(t, w.Gauges, 1)
+	assert.Equal(t, time.Unix(1495028550, 0), w.Start)
+	select {
+	case val := <-dc.Read:
+		t.Fatalf("partial interval should be discarded, got %v", val)
+	case <-time.After(100 * time.Millisecond):
+	}
+	sd.ParseLine("gorets:2|c")
+	sd.FlushInterval(w, time.Unix(1495028560, 0))
+	for i := 0; i < 2; i++ {
+		select {
+		case val := <-dc.Read:
+			met := val.(qtypes.Metric)
+			assert.Equal(t, time.Unix(1495028550, 0), met.Time)
+			if met.Name == "gorets" {
+				assert.Equal(t, float64(2), met.Value)
+			}
+		case <-time.After(1500 * time.Millisecond):
+			t.Fatal("metrics receive timeout")
+		}
+	}
+}
+
+func TestWindow_GaugePolicies(t *testing.T) {
+	exp := map[string]float64{
+		GaugeLast:  20,
+		GaugeFirst: 10,
+		GaugeMin:   5,
+		GaugeMax:   30,
+		GaugeAvg:   16.25,
+		GaugeSum:   65,
+	}
+	for policy, val := range exp {
+		w := NewWindow("10s", 10*time.Second, nil)
+		opts := BucketOptions{GaugePolicy: policy}
+		for _, v := range []float64{10, 30, 5, 20} {
+			w.Handle("gid", opts, &qtypes.StatsdPacket{Bucket: "queue.depth", ValFlt: v, Modifier: "g"})
+		}
+		assert.Equal(t, val, w.Gauges["gid"], policy)
+		assert.Equal(t, int64(4), w.GaugeStats["gid"].Count, policy)
+	}
+	// relative updates apply to the value received last, 5, +3, 10, -4 are the values 5, 8, 10, 6
+	exp = map[string]float64{
+		GaugeLast:  6,
+		GaugeFirst: 5,
+		GaugeMin:   5,
+		GaugeMax:   10,
+		GaugeAvg:   7.25,
+		GaugeSum:   14,
+	}
+	for policy, val := range exp {
+		w := NewWindow("10s", 10*time.Second, nil)
+		opts := BucketOptions{GaugePolicy: policy}
+		mp := NewMP()
+		for _, v := range []string{"5", "+3", "10", "-4"} {
+			sp, err := mp.parseLine([]byte("queue.depth:" + v + "|g"))
+			assert.NoError(t, err)
+			w.Handle("gid", opts, sp)
+		}
+		assert.Equal(t, val, w.Gauges["gid"], policy)
+		assert.Equal(t, float64(6), w.GaugeStats["gid"].Last, policy)
+	}
+	// relative values change the aggregated value, a new interval starts afresh
+	w := NewWindow("10s", 10*time.Second, nil)
+	opts := BucketOptions{GaugePolicy: GaugeMax}
+	w.Handle("gid", opts, &qtypes.StatsdPacket{ValFlt: 10, Modifier: "g"})
+	w.Handle("gid", opts, &qtypes.StatsdPacket{ValFlt: 5, ValStr: "+", Modifier: "g"})
+	assert.Equal(t, float64(15), w.Gauges["gid"])
+	w.Reset()
+	w.Handle("gid", opts, &qtypes.StatsdPacket{ValFlt: 3, Modifier: "g"})
+	assert.Equal(t, float64(3), w.Gauges["gid"])
+}
+
+func TestStatsQGaugePolicies(t *testing.T) {
+	pre := map[string]string{
+		"gauge-avg": "^queue\\.",
+		"gauge-max": "^queue\\.depth$,^mem\\.",
+	}
+	qchan := qtypes.NewQChan()
+	sd := NewNamedStatsQ("", NewPreCfg(pre), qchan)
+	qchan.Broadcast()
+	dc := qchan.Data.Join()
+	assert.Equal(t, GaugeMax, sd.OptionsFor("queue.depth").GaugePolicy, "policies are matched in a fixed order")
+	assert.Equal(t, GaugeAvg, sd.OptionsFor("queue.age").GaugePolicy)
+	assert.Equal(t, GaugeLast, sd.OptionsFor("cpu.load").GaugePolicy)
+	sd.ParseLine("queue.age:10|g host=a")
+	sd.ParseLine("queue.age:20|g host=a")
+	sd.FanOutGauges(time.Unix(1495028544, 0))
+	select {
+	case val := <-dc.Read:
+		met := val.(qtypes.Metric)
+		assert.Equal(t, "queue.age", met.Name)
+		assert.Equal(t, float64(15), met.Value)
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("metrics receive timeout")
+	}
+	assert.Len(t, sd.GaugeStats, 0)
+	sd.ParseLine("queue.age:40|g host=a")
+	assert.Equal(t, float64(40), sd.Gauges[GenID("queue.age_host=a")])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/qnib/statsq/lib"
 	"github.com/zpatrick/go-config"
@@ -11,15 +12,17 @@ const (
 	VERSION = "0.0.0"
 )
 
-func Run(ctx *cli.Context) {
+func Run(ctx *cli.Context) error {
 
-	cfg := config.NewConfig(
-		[]config.Provider{
-			config.NewCLI(ctx, false),
-		},
-	)
+	cfg, err := statsq.NewDaemonConfig(ctx.String("config"), config.NewCLI(ctx, false))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("ERROR: reading config: %s", err), 1)
+	}
 	sd := statsq.NewStatsQ(cfg)
-	sd.Run()
+	if err := sd.Run(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("ERROR: %s", err), 1)
+	}
+	return nil
 }
 
 func main() {
@@ -28,26 +31,115 @@ func main() {
 	app.Usage = "statsq [options]"
 	app.Version = VERSION
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "INI file with settings, e.g. the filters, backends and rules configured by name; flags take precedence",
+		},
 		cli.StringFlag{
 			Name:  "address",
 			Value: ":8125",
-			Usage: "UDP service address",
+			Usage: "UDP service address (or - to disable)",
 		},
 		cli.StringFlag{
 			Name:  "tcpaddr",
 			Value: "",
 			Usage: "TCP service address",
 		},
+		cli.StringFlag{
+			Name:  "graphite-input",
+			Value: "",
+			Usage: "Address to accept the graphite plaintext protocol on, via TCP and UDP (e.g. :2003)",
+		},
+		cli.StringFlag{
+			Name:  "http-addr",
+			Value: "",
+			Usage: "HTTP ingestion service address (POST /v1/statsd and /v1/metrics)",
+		},
+		cli.IntFlag{
+			Name:  "http-max-body",
+			Value: 1048576,
+			Usage: "Maximum size of an HTTP request body in bytes, compressed and uncompressed",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Value: "",
+			Usage: "Certificate (PEM) of the TCP listener, enables TLS along with --tls-key",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Value: "",
+			Usage: "Private key (PEM) of the TCP listener",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-ca",
+			Value: "",
+			Usage: "CA (PEM) to verify client certificates against, requires clients to authenticate (mTLS)",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-dimension",
+			Value: "",
+			Usage: "Dimension set to the common name of the client certificate, overriding the one sent (e.g. client)",
+		},
+		cli.StringFlag{
+			Name:  "unixgram-socket",
+			Value: "",
+			Usage: "Path of a unix datagram socket to listen on",
+		},
+		cli.StringFlag{
+			Name:  "unix-socket",
+			Value: "",
+			Usage: "Path of a unix stream socket to listen on",
+		},
+		cli.StringFlag{
+			Name:  "unix-socket-mode",
+			Value: "",
+			Usage: "Permissions of the unix socket files in octal, e.g. 0660",
+		},
+		cli.StringFlag{
+			Name:  "unix-socket-owner",
+			Value: "",
+			Usage: "Owner (name or uid) of the unix socket files",
+		},
+		cli.StringFlag{
+			Name:  "unix-socket-group",
+			Value: "",
+			Usage: "Group (name or gid) of the unix socket files",
+		},
+		cli.BoolFlag{
+			Name:  "unix-peercred",
+			Usage: "Add the pid and uid of the sending process as dimensions to the packets received on unix sockets (Linux)",
+		},
 		cli.IntFlag{
 			Name:  "max-udp-packet-size",
 			Value: 1472,
 			Usage: "Maximum UDP packet size",
 		},
+		cli.IntFlag{
+			Name:  "udp-readers",
+			Value: 1,
+			Usage: "Number of UDP sockets sharing the address via SO_REUSEPORT, each read by its own goroutine (Linux)",
+		},
+		cli.IntFlag{
+			Name:  "udp-rcvbuf",
+			Value: 0,
+			Usage: "SO_RCVBUF of the UDP sockets in bytes (0 keeps the OS default, capped by net.core.rmem_max)",
+		},
+		cli.IntFlag{
+			Name:  "udp-batch",
+			Value: 1,
+			Usage: "Number of datagrams read per recvmmsg call (Linux)",
+		},
 		cli.StringFlag{
 			Name:  "graphite",
 			Value: "127.0.0.1:2003",
 			Usage: "Graphite service address (or - to disable)",
 		},
+		cli.StringFlag{
+			Name:  "shutdown-timeout",
+			Value: "10s",
+			Usage: "How long to wait for the listeners and the final flush on SIGTERM/SIGINT, exits with 1 if exceeded",
+		},
 		cli.IntFlag{
 			Name:  "flush-interval",
 			Value: 10,
@@ -59,7 +151,21 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:  "resent-gauges",
-			Usage: "do sent values to graphite for inactive gauges, as opposed to not sending the previous value",
+			Usage: "resend the previous value of inactive gauges at every flush (overrides --delete-gauges)",
+		},
+		cli.BoolFlag{
+			Name:  "delete-gauges",
+			Usage: "send gauges once and drop them afterwards, so that relative updates start from 0",
+		},
+		cli.StringFlag{
+			Name:  "gauge-resend",
+			Value: "",
+			Usage: "How often the previous value of inactive gauges is resent: once, forever or a number of intervals (default forever)",
+		},
+		cli.StringFlag{
+			Name:  "gauge-resend-rules",
+			Value: "",
+			Usage: "Comma separated list of rules overriding --gauge-resend, each configured by bucket and mode in a [gauge-resend.<name>] section of --config",
 		},
 		cli.IntFlag{
 			Name:  "persist-count-keys",
@@ -86,6 +192,155 @@ func main() {
 			Value: "",
 			Usage: "Comma separated list of percentiles",
 		},
+		cli.StringFlag{
+			Name:  "percentile-method",
+			Value: "nearest-rank",
+			Usage: "How to calculate percentiles of timers (nearest-rank|linear|hf7)",
+		},
+		cli.IntFlag{
+			Name:  "shards",
+			Value: 1,
+			Usage: "Number of goroutines aggregating packets, series are assigned to them by hash",
+		},
+		cli.IntFlag{
+			Name:  "queue-size",
+			Value: 1000,
+			Usage: "Number of packets queued for each shard",
+		},
+		cli.StringFlag{
+			Name:  "queue-overflow",
+			Value: "block",
+			Usage: "What to do if a queue is full (block|drop-newest|drop-oldest)",
+		},
+		cli.StringFlag{
+			Name:  "self-metrics",
+			Value: "",
+			Usage: "Prefix of the metrics about dropped packets, queue high-water marks and UDP overruns (disabled if empty)",
+		},
+		cli.StringFlag{
+			Name:  "intervals",
+			Value: "",
+			Usage: "Comma separated list of flush intervals (e.g. 10s,1m), each sending to the backends of its [interval.<interval>] section of --config (default all)",
+		},
+		cli.BoolFlag{
+			Name:  "align-flushes",
+			Usage: "flush on multiples of the interval (e.g. :00, :10, :20) instead of relative to the start",
+		},
+		cli.StringFlag{
+			Name:  "flush-timestamp",
+			Value: "end",
+			Usage: "Timestamp metrics with the start or end of their interval (start|end)",
+		},
+		cli.StringFlag{
+			Name:  "partial-interval",
+			Value: "flush",
+			Usage: "How to handle the first, partial interval of aligned flushes (flush|discard)",
+		},
+		cli.StringFlag{
+			Name:  "timer-sketch",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose timers are kept in a DDSketch instead of all samples",
+		},
+		cli.StringFlag{
+			Name:  "timer-sketch-accuracy",
+			Value: "0.01",
+			Usage: "Relative accuracy of the timer percentiles calculated from a sketch",
+		},
+		cli.IntFlag{
+			Name:  "timer-sketch-max-bins",
+			Value: 2048,
+			Usage: "Maximum number of bins per sign of a timer sketch, the ones of the smallest values are collapsed beyond",
+		},
+		cli.StringFlag{
+			Name:  "set-hll",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose sets are counted with a HyperLogLog",
+		},
+		cli.StringFlag{
+			Name:  "gauge-first",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose gauges keep the first value of an interval",
+		},
+		cli.StringFlag{
+			Name:  "gauge-min",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose gauges keep the minimum of an interval",
+		},
+		cli.StringFlag{
+			Name:  "gauge-max",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose gauges keep the maximum of an interval",
+		},
+		cli.StringFlag{
+			Name:  "gauge-avg",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose gauges are averaged within an interval",
+		},
+		cli.StringFlag{
+			Name:  "gauge-sum",
+			Value: "",
+			Usage: "Comma separated list of bucket regexes whose gauges are summed up within an interval",
+		},
+		cli.IntFlag{
+			Name:  "set-hll-precision",
+			Value: 14,
+			Usage: "Precision of the HyperLogLog sets (4-18, up to 2^precision bytes per set)",
+		},
+		cli.StringFlag{
+			Name:  "topk",
+			Value: "",
+			Usage: "Comma separated list of top-K rules, each configured by bucket, dimension, k and capacity in a [topk.<name>] section of --config",
+		},
+		cli.StringFlag{
+			Name:  "derived",
+			Value: "",
+			Usage: "Comma separated list of derived metrics, each configured by expr and missing in a [derived.<name>] section of --config",
+		},
+		cli.StringFlag{
+			Name:  "alerts",
+			Value: "",
+			Usage: "Comma separated list of alerts, each configured by rule (e.g. 'api.latency.upper_99 > 500 for 3 intervals') and webhook in an [alert.<name>] section of --config",
+		},
+		cli.StringFlag{
+			Name:  "alert-webhook",
+			Value: "",
+			Usage: "URL alert notifications are POSTed to, unless the section of the alert sets a webhook",
+		},
+		cli.StringFlag{
+			Name:  "global-dimensions",
+			Value: "",
+			Usage: "Comma separated list of key=value dimensions added to all metrics",
+		},
+		cli.StringFlag{
+			Name:  "global-dimensions-env",
+			Value: "",
+			Usage: "Comma separated list of key=ENV_VAR dimensions added to all metrics",
+		},
+		cli.StringFlag{
+			Name:  "global-dimensions-hostname",
+			Value: "",
+			Usage: "Dimension key to add the hostname to all metrics (empty to disable)",
+		},
+		cli.StringFlag{
+			Name:  "global-dimensions-precedence",
+			Value: "global",
+			Usage: "Which value wins if a client sets a global dimension key (global|client)",
+		},
+		cli.StringFlag{
+			Name:  "backends",
+			Value: "",
+			Usage: "Comma separated list of backends (qchan, graphite, log or names configured in a [backend.<name>] section of --config)",
+		},
+		cli.StringFlag{
+			Name:  "ingest-allow",
+			Value: "",
+			Usage: "Comma separated list of filters ([filter.<name>] sections of --config with name, type and dimensions) an incoming metric has to match",
+		},
+		cli.StringFlag{
+			Name:  "ingest-deny",
+			Value: "",
+			Usage: "Comma separated list of filters ([filter.<name>] sections of --config) to drop incoming metrics",
+		},
 	}
 	app.Action = Run
 	app.Run(os.Args)